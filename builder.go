@@ -0,0 +1,240 @@
+package textmate
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/friedelschoen/go-textmate/regexp"
+)
+
+// GrammarBuilder constructs a grammar in Go code, see NewGrammar.
+type GrammarBuilder struct {
+	grammar GrammarJSON
+}
+
+// NewGrammar starts a grammar named scope. Rules are added in order, their patterns and
+// includes are validated when the grammar is built:
+//
+//	grammar, err := textmate.NewGrammar("source.ini").
+//		FileTypes("ini").
+//		Match("comment.line.ini", `;.*$`).
+//		Block("string.quoted.ini", `"`, `"`, textmate.Match("constant.character.escape.ini", `\\.`)).
+//		Include("#keys").
+//		Repository("keys", textmate.Match("keyword.other.ini", `^\w+(?==)`)).
+//		Compile(loader)
+func NewGrammar(scope string) *GrammarBuilder {
+	return &GrammarBuilder{grammar: GrammarJSON{ScopeName: scope}}
+}
+
+// Match returns a rule which scopes every match of pattern.
+func Match(scope string, pattern string) RuleJSON {
+	return RuleJSON{Name: scope, Match: pattern}
+}
+
+// Block returns a rule which scopes the text from begin to end, patterns apply in between.
+func Block(scope string, begin string, end string, patterns ...RuleJSON) RuleJSON {
+	return RuleJSON{Name: scope, Begin: begin, End: end, Patterns: patterns}
+}
+
+// Include returns a rule which includes `#name` of the repository, `$self`, `$base` or another grammar.
+func Include(ref string) RuleJSON {
+	return RuleJSON{Include: ref}
+}
+
+// Patterns returns a rule which tries every rule in order.
+func Patterns(rules ...RuleJSON) RuleJSON {
+	return RuleJSON{Patterns: rules}
+}
+
+// Capture scopes the capture group of a match, or of both begin and end of a block.
+func (r RuleJSON) Capture(group int, scope string) RuleJSON {
+	r.Captures = withCapture(r.Captures, group, scope)
+	return r
+}
+
+// BeginCapture scopes the capture group of begin of a block.
+func (r RuleJSON) BeginCapture(group int, scope string) RuleJSON {
+	r.BeginCaptures = withCapture(r.BeginCaptures, group, scope)
+	return r
+}
+
+// EndCapture scopes the capture group of end of a block.
+func (r RuleJSON) EndCapture(group int, scope string) RuleJSON {
+	r.EndCaptures = withCapture(r.EndCaptures, group, scope)
+	return r
+}
+
+// withCapture returns a copy of captures with group set, the rule it was taken from is left as-is.
+func withCapture(captures map[string]RuleJSON, group int, scope string) map[string]RuleJSON {
+	captures = maps.Clone(captures)
+	if captures == nil {
+		captures = make(map[string]RuleJSON)
+	}
+	captures[strconv.Itoa(group)] = RuleJSON{Name: scope}
+	return captures
+}
+
+// Name sets the display name of the grammar.
+func (b *GrammarBuilder) Name(name string) *GrammarBuilder {
+	b.grammar.Name = name
+	return b
+}
+
+// FileTypes adds file extensions or names which the grammar is used for.
+func (b *GrammarBuilder) FileTypes(fts ...string) *GrammarBuilder {
+	b.grammar.FileTypes = append(b.grammar.FileTypes, fts...)
+	return b
+}
+
+// FirstLine sets the pattern which recognizes files by their first line.
+func (b *GrammarBuilder) FirstLine(pattern string) *GrammarBuilder {
+	b.grammar.FirstLine = pattern
+	return b
+}
+
+// Match adds a rule which scopes every match of pattern, see Match.
+func (b *GrammarBuilder) Match(scope string, pattern string) *GrammarBuilder {
+	return b.Add(Match(scope, pattern))
+}
+
+// Block adds a rule which scopes the text from begin to end, see Block.
+func (b *GrammarBuilder) Block(scope string, begin string, end string, patterns ...RuleJSON) *GrammarBuilder {
+	return b.Add(Block(scope, begin, end, patterns...))
+}
+
+// Include adds an include of ref, see Include.
+func (b *GrammarBuilder) Include(ref string) *GrammarBuilder {
+	return b.Add(Include(ref))
+}
+
+// Add adds rules to the top-level patterns.
+func (b *GrammarBuilder) Add(rules ...RuleJSON) *GrammarBuilder {
+	b.grammar.Patterns = append(b.grammar.Patterns, rules...)
+	return b
+}
+
+// Repository sets the rule which is included as `#name`, replacing a rule set before; multiple
+// rules are tried in order.
+func (b *GrammarBuilder) Repository(name string, rules ...RuleJSON) *GrammarBuilder {
+	r := Patterns(rules...)
+	if len(rules) == 1 {
+		r = rules[0]
+	}
+	if b.grammar.Repository == nil {
+		b.grammar.Repository = make(map[string]RuleJSON)
+	}
+	b.grammar.Repository[name] = r
+	return b
+}
+
+// Build returns the grammar, or CompileErrors listing every invalid pattern and every
+// include of a rule missing in the repository. Patterns are validated as CompileGrammar
+// compiles them without a loader.
+func (b *GrammarBuilder) Build() (*GrammarJSON, error) {
+	return b.build(RegexpConfig{})
+}
+
+// Compile builds the grammar and compiles it with CompileGrammar. Patterns are validated with
+// the regexp configuration of l, includes of other grammars must be known to l, which may be
+// nil for grammars without them.
+func (b *GrammarBuilder) Compile(l *Loader) (*Grammar, error) {
+	var cfg RegexpConfig
+	if l != nil {
+		cfg = l.regexpConfig(b.grammar.ScopeName)
+	}
+	j, err := b.build(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var errs CompileErrors
+	walkRules(j, func(r RuleJSON, path string) {
+		scopename, _, _ := strings.Cut(r.Include, "#")
+		if scopename == "" || scopename == "$self" || scopename == "$base" {
+			return
+		}
+		if l == nil || !l.hasScope(scopename) {
+			errs = append(errs, b.errorAt(jsonPath(path, "include"), fmt.Errorf("unknown grammar `%s`", scopename)))
+		}
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return CompileGrammar(l, j)
+}
+
+// build returns the grammar, validating its patterns as compiled with cfg.
+func (b *GrammarBuilder) build(cfg RegexpConfig) (*GrammarJSON, error) {
+	var errs CompileErrors
+	check := func(source string, path string) {
+		if source == "" {
+			return
+		}
+		expr, err := regexp.CompileSyntax(source, cfg.Options, cfg.Syntax)
+		if err != nil {
+			errs = append(errs, b.errorAt(path, err))
+			return
+		}
+		expr.Free()
+	}
+	check(b.grammar.FirstLine, "firstLineMatch")
+	walkRules(&b.grammar, func(r RuleJSON, path string) {
+		if (r.Begin != "") != (r.End != "" || r.While != "") {
+			errs = append(errs, b.errorAt(path, errors.New("found rule with begin or end omitted")))
+		}
+		check(r.Match, jsonPath(path, "match"))
+		check(r.Begin, jsonPath(path, "begin"))
+		check(r.End, jsonPath(path, "end"))
+		check(r.While, jsonPath(path, "while"))
+		if name, ok := strings.CutPrefix(r.Include, "#"); ok {
+			if _, ok := b.grammar.Repository[name]; !ok {
+				errs = append(errs, b.errorAt(jsonPath(path, "include"), fmt.Errorf("unknown rule `%s`", name)))
+			}
+		}
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	res := b.grammar
+	res.FileTypes = slices.Clone(res.FileTypes)
+	res.Patterns = slices.Clone(res.Patterns)
+	res.Repository = maps.Clone(res.Repository)
+	return &res, nil
+}
+
+func (b *GrammarBuilder) errorAt(path string, err error) *CompileError {
+	return &CompileError{Scope: b.grammar.ScopeName, Path: path, Err: err}
+}
+
+// walkRules calls fn for every rule in j, including the rules of its repository and captures.
+func walkRules(j *GrammarJSON, fn func(r RuleJSON, path string)) {
+	for i, r := range j.Patterns {
+		walkRule(r, fmt.Sprintf("patterns[%d]", i), fn)
+	}
+	for _, name := range slices.Sorted(maps.Keys(j.Repository)) {
+		walkRule(j.Repository[name], jsonPath("repository", name), fn)
+	}
+}
+
+// walkRule calls fn for r and every rule nested in it, disabled rules are skipped as they are not compiled.
+func walkRule(r RuleJSON, path string, fn func(r RuleJSON, path string)) {
+	if r.Disabled {
+		return
+	}
+	fn(r, path)
+	for i, child := range r.Patterns {
+		walkRule(child, fmt.Sprintf("%s[%d]", jsonPath(path, "patterns"), i), fn)
+	}
+	walkCaptures(r.Captures, jsonPath(path, "captures"), fn)
+	walkCaptures(r.BeginCaptures, jsonPath(path, "beginCaptures"), fn)
+	walkCaptures(r.EndCaptures, jsonPath(path, "endCaptures"), fn)
+}
+
+func walkCaptures(captures map[string]RuleJSON, path string, fn func(r RuleJSON, path string)) {
+	for _, num := range slices.Sorted(maps.Keys(captures)) {
+		walkRule(captures[num], jsonPath(path, num), fn)
+	}
+}
@@ -0,0 +1,77 @@
+package textmate
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/friedelschoen/go-textmate/regexp"
+)
+
+func TestGrammarBuilder(t *testing.T) {
+	tests := []struct {
+		name    string
+		builder *GrammarBuilder
+		errs    []string /* paths of the errors, none if the grammar builds */
+	}{
+		{"valid", NewGrammar("source.test").
+			Match("keyword", `\bif\b`).
+			Block("string", `"`, `"`, Match("escape", `\\.`)).
+			Include("#numbers").
+			Repository("numbers", Match("number", `\d+`)), nil},
+		{"invalid patterns", NewGrammar("source.test").
+			FirstLine(`(`).
+			Match("keyword", `[`).
+			Block("string", `"`, `(`), []string{"firstLineMatch", "patterns[0].match", "patterns[1].end"}},
+		{"missing end", NewGrammar("source.test").
+			Add(RuleJSON{Begin: `a`}), []string{"patterns[0]"}},
+		{"unknown rule", NewGrammar("source.test").
+			Include("#missing"), []string{"patterns[0].include"}},
+		{"nested", NewGrammar("source.test").
+			Repository("a.b", Patterns(Match("x", `a`), Match("y", `(`))), []string{`repository["a.b"].patterns[1].match`}},
+		{"redefined", NewGrammar("source.test").
+			Repository("numbers", Match("number", `(`)).
+			Repository("numbers", Match("number", `\d+`)), nil},
+		{"disabled", NewGrammar("source.test").
+			Add(RuleJSON{Match: `(`, Disabled: true}), nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := test.builder.Build()
+			var errs CompileErrors
+			if err != nil && !errors.As(err, &errs) {
+				t.Fatalf("got %v, want CompileErrors", err)
+			}
+			var paths []string
+			for _, err := range errs {
+				paths = append(paths, err.Path)
+			}
+			if !slices.Equal(paths, test.errs) {
+				t.Errorf("got errors %v, want at %q", errs, test.errs)
+			}
+		})
+	}
+}
+
+func TestGrammarBuilderCompile(t *testing.T) {
+	/* named groups are written `(?P<name>...)` in Python, which the default syntax rejects */
+	b := NewGrammar("source.test").Match("keyword", `(?P<kw>if)`)
+	if _, err := b.Build(); err == nil {
+		t.Error("Build accepts a pattern of another syntax")
+	}
+	l, _ := NewLoader(nil, WithRegexpConfig(RegexpConfig{Syntax: regexp.SyntaxPython}))
+	g, err := b.Compile(l)
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	defer g.Close()
+	if got := scopes(t, g, "if"); !slices.Equal(got, []string{"keyword:if"}) {
+		t.Errorf("got %q, want keyword:if", got)
+	}
+
+	_, err = NewGrammar("source.test").Include("source.other").Compile(l)
+	var errs CompileErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Path != "patterns[0].include" {
+		t.Errorf("got %v, want unknown grammar at patterns[0].include", err)
+	}
+}
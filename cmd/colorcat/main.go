@@ -2,13 +2,11 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"maps"
 	"os"
-	"path"
 	"path/filepath"
 	"slices"
 	"strings"
@@ -23,39 +21,42 @@ var themeDir = "share/colorcat/themes"
 func main() {
 	// Flags
 	var grammarName, themeName string
-	var transparent, doList bool
-	flag.StringVar(&grammarName, "syntax", "", "Name")
+	var transparent, doList, verbose, doExplain, doDeps, doDot bool
+	flag.StringVar(&grammarName, "syntax", "", "Language, alias or file type")
 	flag.StringVar(&themeName, "theme", "default", "Theme")
 	flag.BoolVar(&transparent, "transparent", false, "Theme")
 	flag.BoolVar(&doList, "list", false, "List all themes and available syntaxes")
+	flag.BoolVar(&verbose, "v", false, "Report grammars which could not be loaded")
+	flag.BoolVar(&doExplain, "explain", false, "Explain which grammar is used for the file and why")
+	flag.BoolVar(&doDeps, "deps", false, "List the grammars included by every grammar")
+	flag.BoolVar(&doDot, "dot", false, "List the grammars included by every grammar in DOT format")
 	flag.Parse()
 
 	userdir, userdirErr := os.UserHomeDir()
 
-	loader, _ := textmate.NewLoader(func(yield func(string) bool) {
-		dir := filepath.Join("/usr", grammarDir)
-		entries, _ := os.ReadDir(dir)
-		for _, entry := range entries {
-			if !entry.IsDir() {
-				if !yield(path.Join(dir, entry.Name())) {
-					return
-				}
-			}
-		}
-		if userdirErr == nil {
-			dir = filepath.Join(userdir, ".local", grammarDir)
-			entries, _ = os.ReadDir(dir)
-			for _, entry := range entries {
-				if !entry.IsDir() {
-					if !yield(path.Join(dir, entry.Name())) {
-						return
-					}
-				}
-			}
-		}
-	})
+	var loaderOpts []textmate.LoaderOption
+	if cachedir, err := os.UserCacheDir(); err == nil {
+		loaderOpts = append(loaderOpts, textmate.WithCache(filepath.Join(cachedir, "colorcat", "grammars.cache")))
+	}
+	if verbose {
+		loaderOpts = append(loaderOpts, textmate.WithLogger(func(diag textmate.Diagnostic) {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", diag)
+		}))
+	}
+
+	// User grammars override system grammars
+	loader, _ := textmate.NewLoader(nil, loaderOpts...)
+	loader.AddDir(filepath.Join("/usr", grammarDir), false, textmate.TierSystem)
+	if userdirErr == nil {
+		loader.AddDir(filepath.Join(userdir, ".local", grammarDir), false, textmate.TierUser)
+	}
 
 	if doList {
+		fmt.Println("Languages:")
+		for _, lang := range loader.Languages() {
+			fmt.Printf("- %s (%s): %s\n", lang.ID, lang.Name, strings.Join(lang.Aliases, ", "))
+		}
+
 		fmt.Println("File Types:")
 		fts := slices.Collect(loader.FileTypes())
 		names := maps.Collect(loader.FileTypeNames())
@@ -67,14 +68,53 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Defaults if not set
-	themePath := filepath.Join("/usr", themeDir, themeName+".json")
-	if _, err := os.Stat(themePath); err != nil {
-		if userdirErr != nil {
-			fmt.Fprintf(os.Stderr, "unable to determine home directory: %v\n", err)
+	if doExplain {
+		var res textmate.Resolution
+		var err error
+		switch {
+		case grammarName != "":
+			if lang, ok := loader.Language(grammarName); ok && lang.Scope != "" {
+				res, err = loader.ExplainScope(lang.Scope)
+				res.Match = fmt.Sprintf("language `%s`", lang.ID)
+			} else {
+				res, err = loader.ExplainFileType(grammarName)
+			}
+		case flag.NArg() > 0:
+			res, err = loader.ExplainFileName(flag.Arg(0))
+		default:
+			fmt.Fprintf(os.Stderr, "-explain requires -syntax or a file\n")
 			os.Exit(1)
 		}
-		themePath = filepath.Join(userdir, ".local", themeDir, themeName+".json")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "no grammar found: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s:\n", res.Match)
+		for _, cand := range res.Candidates {
+			fmt.Printf("- %s (%s, %v): %s\n", cand.Scope, cand.File, cand.Tier, cand.Reason)
+		}
+		os.Exit(0)
+	}
+
+	if doDeps || doDot {
+		graph := loader.DependencyGraph()
+		if doDot {
+			printDot(graph)
+		} else {
+			printDeps(graph)
+		}
+		os.Exit(0)
+	}
+
+	// Defaults if not set
+	themeDirs := []string{filepath.Join("/usr", themeDir)}
+	if userdirErr == nil {
+		themeDirs = append(themeDirs, filepath.Join(userdir, ".local", themeDir))
+	}
+	themePath, ok := findTheme(themeDirs, themeName)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "theme `%s` not found in %s\n", themeName, strings.Join(themeDirs, ", "))
+		os.Exit(1)
 	}
 
 	sourceFile := os.Stdin
@@ -88,13 +128,20 @@ func main() {
 			fmt.Fprintf(os.Stderr, "failed to load file `%s`: %v\n", name, err)
 			os.Exit(1)
 		}
-		if grammarName == "" {
-			grammarName = strings.TrimPrefix(path.Ext(name), ".")
-		}
 	}
 
-	// Load grammar
-	grammar, err := loader.FromFileType(grammarName, 0)
+	// Load grammar, by the name of the source file unless given
+	var grammar *textmate.Grammar
+	var err error
+	if grammarName == "" && flag.NArg() > 0 {
+		grammarName = flag.Arg(0)
+		grammar, err = loader.FromFileName(grammarName)
+	} else {
+		grammar, err = loader.FromLanguage(grammarName)
+		if err != nil {
+			grammar, err = loader.FromFileType(grammarName, 0)
+		}
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to load grammar `%s`: %v\n", grammarName, err)
 		os.Exit(1)
@@ -106,9 +153,9 @@ func main() {
 		fmt.Fprintf(os.Stderr, "failed to read theme: %v\n", err)
 		os.Exit(1)
 	}
-	var themeJSON theme.ThemeJSON
-	if err := json.Unmarshal(themeBytes, &themeJSON); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to parse theme JSON: %v\n", err)
+	themeJSON, err := theme.DecodeTheme(themeBytes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to parse theme: %v\n", err)
 		os.Exit(1)
 	}
 	t := theme.ParseTheme(themeJSON)
@@ -189,3 +236,54 @@ func main() {
 	// Reset formatting at the end
 	fmt.Printf("\033[0m\n")
 }
+
+// findTheme looks up the theme file named name, written in JSON or YAML, in dirs.
+func findTheme(dirs []string, name string) (string, bool) {
+	for _, dir := range dirs {
+		for _, ext := range []string{".json", ".yaml", ".yml"} {
+			pathname := filepath.Join(dir, name+ext)
+			if _, err := os.Stat(pathname); err == nil {
+				return pathname, true
+			}
+		}
+	}
+	return "", false
+}
+
+// printDeps lists the dependencies of every grammar.
+func printDeps(graph []textmate.Dependencies) {
+	for _, deps := range graph {
+		fmt.Printf("%s:\n", deps.Scope)
+		if len(deps.Direct) > 0 {
+			fmt.Printf("  includes: %s\n", strings.Join(deps.Direct, ", "))
+		}
+		if len(deps.Transitive) > len(deps.Direct) {
+			fmt.Printf("  transitive: %s\n", strings.Join(deps.Transitive, ", "))
+		}
+		if len(deps.Missing) > 0 {
+			fmt.Printf("  missing: %s\n", strings.Join(deps.Missing, ", "))
+		}
+		if deps.Err != nil {
+			fmt.Printf("  error: %s\n", strings.ReplaceAll(deps.Err.Error(), "\n", "\n         "))
+		}
+	}
+}
+
+// printDot writes the direct dependencies as a DOT graph, missing grammars are dashed.
+func printDot(graph []textmate.Dependencies) {
+	fmt.Println("digraph grammars {")
+	missing := make(map[string]bool)
+	for _, deps := range graph {
+		fmt.Printf("\t%q;\n", deps.Scope)
+		for _, dep := range deps.Direct {
+			fmt.Printf("\t%q -> %q;\n", deps.Scope, dep)
+		}
+		for _, dep := range deps.Missing {
+			missing[dep] = true
+		}
+	}
+	for _, dep := range slices.Sorted(maps.Keys(missing)) {
+		fmt.Printf("\t%q [style=dashed];\n", dep)
+	}
+	fmt.Println("}")
+}
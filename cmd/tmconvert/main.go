@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/friedelschoen/go-textmate"
+)
+
+func main() {
+	// Flags
+	var from, to, output, overlay string
+	var strict bool
+	flag.StringVar(&from, "from", "", "Format of the input: json, plist or yaml (detected if empty)")
+	flag.StringVar(&to, "to", "", "Format of the output: json, plist or yaml (by extension of -o if empty, else json)")
+	flag.StringVar(&output, "o", "", "Output file (standard output if empty)")
+	flag.StringVar(&overlay, "overlay", "", "Overlay to apply to the grammar before writing")
+	flag.BoolVar(&strict, "strict", false, "Fail instead of warning about keys which would be dropped")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [options] [grammar]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Converts TextMate grammars; Sublime syntaxes have no TextMate equivalent and are refused.\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Keys which are not kept, such as `contentName` or `uuid`, are reported on standard error.\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// Read grammar
+	name := "<stdin>"
+	var content []byte
+	var err error
+	if flag.NArg() > 0 {
+		name = flag.Arg(0)
+		content, err = os.ReadFile(name)
+	} else {
+		content, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read `%s`: %v\n", name, err)
+		os.Exit(1)
+	}
+
+	inFormat := textmate.DetectFormat(name, content)
+	if from != "" {
+		inFormat, err = textmate.ParseFormat(from)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+	outFormat := formatByName(output)
+	if to != "" {
+		outFormat, err = textmate.ParseFormat(to)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if strings.HasSuffix(strings.ToLower(name), ".sublime-syntax") {
+		fmt.Fprintf(os.Stderr, "failed to convert `%s`: %v\n", name, textmate.ErrNotEncodable)
+		os.Exit(1)
+	}
+
+	/* report what the output would lack, as the grammar is written in full otherwise */
+	dropped, err := textmate.DroppedKeys(content, inFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to decode `%s` as %v: %v\n", name, inFormat, err)
+		os.Exit(1)
+	}
+	for _, keyErr := range dropped {
+		fmt.Fprintf(os.Stderr, "warning: %s: %v, dropped\n", name, keyErr)
+	}
+	if strict && len(dropped) > 0 {
+		os.Exit(1)
+	}
+
+	grammar, err := textmate.DecodeGrammar(content, inFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to decode `%s` as %v: %v\n", name, inFormat, err)
+		os.Exit(1)
+	}
+
+	if overlay != "" {
+		grammar, err = applyOverlay(grammar, overlay)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to apply `%s`: %v\n", overlay, err)
+			os.Exit(1)
+		}
+	}
+
+	// Write grammar, encoded first to not leave a broken output behind
+	var buf bytes.Buffer
+	if err := textmate.EncodeGrammar(&buf, grammar, outFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode as %v: %v\n", outFormat, err)
+		os.Exit(1)
+	}
+	if output != "" {
+		err = os.WriteFile(output, buf.Bytes(), 0o644)
+	} else {
+		_, err = buf.WriteTo(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// applyOverlay applies the overlay in the file at path to grammar.
+func applyOverlay(grammar *textmate.GrammarJSON, path string) (*textmate.GrammarJSON, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	o, err := textmate.DecodeOverlay(content, textmate.DetectFormat(path, content))
+	if err != nil {
+		return nil, err
+	}
+	return o.Apply(grammar)
+}
+
+// formatByName returns the format conventionally used for files named like name.
+func formatByName(name string) textmate.Format {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".tmlanguage"), strings.HasSuffix(name, ".plist"):
+		return textmate.FormatPlist
+	case strings.HasSuffix(name, ".yaml"), strings.HasSuffix(name, ".yml"), strings.HasSuffix(name, ".yaml-tmlanguage"):
+		return textmate.FormatYAML
+	}
+	return textmate.FormatJSON
+}
@@ -5,12 +5,17 @@
 package textmate
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/friedelschoen/go-textmate/regexp"
+	"go.yaml.in/yaml/v3"
 )
 
 var (
@@ -30,41 +35,216 @@ const (
 // GrammarJSON mirrors the (subset of) TextMate JSON/Plist grammar on disk.
 // It is decoded as-is and later compiled into Grammar.
 type GrammarJSON struct {
-	Name         string              `json:"name" plist:"name"`
-	ScopeName    string              `json:"scopeName" plist:"scopeName"`
-	FileTypes    []string            `json:"fileTypes" plist:"fileTypes"`
-	FoldingStart string              `json:"foldingStartMarker" plist:"foldingStartMarker"`
-	FoldingEnd   string              `json:"foldingStopMarker" plist:"foldingStopMarker"`
-	FirstLine    string              `json:"firstLineMatch" plist:"firstLineMatch"`
-	Repository   map[string]RuleJSON `json:"repository" plist:"repository"`
-	Patterns     []RuleJSON          `json:"patterns" plist:"patterns"`
+	Name         string              `json:"name,omitempty" plist:"name,omitempty" yaml:"name,omitempty"`
+	ScopeName    string              `json:"scopeName,omitempty" plist:"scopeName,omitempty" yaml:"scopeName,omitempty"`
+	FileTypes    []string            `json:"fileTypes,omitempty" plist:"fileTypes,omitempty" yaml:"fileTypes,omitempty"`
+	FoldingStart string              `json:"foldingStartMarker,omitempty" plist:"foldingStartMarker,omitempty" yaml:"foldingStartMarker,omitempty"`
+	FoldingEnd   string              `json:"foldingStopMarker,omitempty" plist:"foldingStopMarker,omitempty" yaml:"foldingStopMarker,omitempty"`
+	FirstLine    string              `json:"firstLineMatch,omitempty" plist:"firstLineMatch,omitempty" yaml:"firstLineMatch,omitempty"`
+	Patterns     []RuleJSON          `json:"patterns,omitempty" plist:"patterns,omitempty" yaml:"patterns,omitempty"`
+	Repository   map[string]RuleJSON `json:"repository,omitempty" plist:"repository,omitempty" yaml:"repository,omitempty"`
+
+	filename string
+	sublime  *SublimeSyntax /* rules are compiled from this syntax instead, see SublimeSyntax.GrammarJSON */
+	tier     Tier
+	seq      int                          /* order of loading, later grammars override earlier ones of the same tier */
+	body     func() (*GrammarJSON, error) /* decodes the rules if only the metadata was decoded */
+	source   *fileSource                  /* file the grammar was loaded from, nil if registered */
 }
 
 // RuleJSON is a raw grammar rule (as found in the JSON file).
 // Note: capture groups are addressed by string indices "1","2",...
 type RuleJSON struct {
-	Name          string              `json:"name" plist:"name"`
-	Match         string              `json:"match" plist:"match"`
-	Begin         string              `json:"begin" plist:"begin"`
-	End           string              `json:"end" plist:"end"`
-	While         string              `json:"while" plist:"while"`
-	Patterns      []RuleJSON          `json:"patterns" plist:"patterns"`
-	Captures      map[string]RuleJSON `json:"captures" plist:"captures"`
-	BeginCaptures map[string]RuleJSON `json:"beginCaptures" plist:"beginCaptures"`
-	EndCaptures   map[string]RuleJSON `json:"endCaptures" plist:"endCaptures"`
-	Include       string              `json:"include" plist:"include"`
-}
-
-// Grammar is the compiled grammar with precompiled regexes and an executable rule tree.
+	Name          string              `json:"name,omitempty" plist:"name,omitempty" yaml:"name,omitempty"`
+	Match         string              `json:"match,omitempty" plist:"match,omitempty" yaml:"match,omitempty"`
+	Begin         string              `json:"begin,omitempty" plist:"begin,omitempty" yaml:"begin,omitempty"`
+	End           string              `json:"end,omitempty" plist:"end,omitempty" yaml:"end,omitempty"`
+	While         string              `json:"while,omitempty" plist:"while,omitempty" yaml:"while,omitempty"`
+	Patterns      []RuleJSON          `json:"patterns,omitempty" plist:"patterns,omitempty" yaml:"patterns,omitempty"`
+	Captures      map[string]RuleJSON `json:"captures,omitempty" plist:"captures,omitempty" yaml:"captures,omitempty"`
+	BeginCaptures map[string]RuleJSON `json:"beginCaptures,omitempty" plist:"beginCaptures,omitempty" yaml:"beginCaptures,omitempty"`
+	EndCaptures   map[string]RuleJSON `json:"endCaptures,omitempty" plist:"endCaptures,omitempty" yaml:"endCaptures,omitempty"`
+	Include       string              `json:"include,omitempty" plist:"include,omitempty" yaml:"include,omitempty"`
+	// Disabled rules never match, as if they were absent.
+	Disabled RuleFlag `json:"disabled,omitempty" plist:"disabled,omitempty" yaml:"disabled,omitempty"`
+	// Comment is left by the author of the grammar, it does not affect highlighting.
+	Comment string `json:"comment,omitempty" plist:"comment,omitempty" yaml:"comment,omitempty"`
+}
+
+// RuleFlag is a boolean of a rule, such as `disabled`, which grammars write as `1` or `true`;
+// it is encoded as `1`.
+type RuleFlag bool
+
+func (f RuleFlag) MarshalJSON() ([]byte, error) {
+	if f {
+		return []byte("1"), nil
+	}
+	return []byte("0"), nil
+}
+
+func (f *RuleFlag) UnmarshalJSON(data []byte) error {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	return f.set(v)
+}
+
+func (f RuleFlag) MarshalPlist() (any, error) {
+	if f {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (f *RuleFlag) UnmarshalPlist(unmarshal func(any) error) error {
+	var v any
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	return f.set(v)
+}
+
+func (f RuleFlag) MarshalYAML() (any, error) {
+	return f.MarshalPlist()
+}
+
+func (f *RuleFlag) UnmarshalYAML(node *yaml.Node) error {
+	var v any
+	if err := node.Decode(&v); err != nil {
+		return err
+	}
+	return f.set(v)
+}
+
+// set assigns a decoded boolean or number: JSON numbers are float64, plist integers int64 or
+// uint64 and YAML integers int, int64 or uint64.
+func (f *RuleFlag) set(v any) error {
+	switch v := v.(type) {
+	case nil:
+		*f = false
+	case bool:
+		*f = RuleFlag(v)
+	case int:
+		*f = v != 0
+	case int64:
+		*f = v != 0
+	case uint64:
+		*f = v != 0
+	case float32:
+		*f = v != 0
+	case float64:
+		*f = v != 0
+	default:
+		return fmt.Errorf("expected boolean or number, found %v", v)
+	}
+	return nil
+}
+
+// RegexpConfig selects how the patterns of a grammar are compiled, a nil Syntax
+// meaning regexp.SyntaxDefault.
+type RegexpConfig struct {
+	Syntax  *regexp.Syntax
+	Options regexp.Option
+}
+
+// CompileMode decides when the patterns of a grammar are compiled.
+type CompileMode int
+
+const (
+	// CompileLazy compiles each pattern when it is first evaluated.
+	CompileLazy CompileMode = iota
+	// CompileEager compiles all patterns in CompileGrammar, failing on the first invalid one.
+	CompileEager
+	// CompileCollect is CompileEager, but reports every invalid rule or pattern as CompileErrors.
+	CompileCollect
+)
+
+// CompileError locates an error in a grammar. Errors of invalid patterns wrap a regexp.RegexpError,
+// which carries the position of the error within the pattern.
+type CompileError struct {
+	// File is the grammar file, empty if the grammar was not loaded from a file.
+	File  string
+	Scope string
+	// Path is the JSON path of the offending value, such as `repository.string-escapes.patterns[2].match`.
+	Path string
+	Err  error
+}
+
+func (err *CompileError) Error() string {
+	file := err.File
+	if file == "" {
+		file = err.Scope
+	}
+	return fmt.Sprintf("%s: %s: %v", file, err.Path, err.Err)
+}
+
+func (err *CompileError) Unwrap() error {
+	return err.Err
+}
+
+// CompileErrors lists every error found in a grammar.
+type CompileErrors []*CompileError
+
+func (errs CompileErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (errs CompileErrors) Unwrap() []error {
+	res := make([]error, len(errs))
+	for i, err := range errs {
+		res[i] = err
+	}
+	return res
+}
+
+// Grammar is the compiled grammar with an executable rule tree. Its regexes are compiled
+// on first use unless the loader uses CompileEager.
 type Grammar struct {
 	loader       *Loader
+	name         string
 	scopeName    string
 	fileTypes    []string
-	foldingStart *regexp.Regexp
-	foldingEnd   *regexp.Regexp
-	firstLine    *regexp.Regexp
+	foldingStart *pattern
+	foldingEnd   *pattern
+	firstLine    *pattern
 	repository   map[string]rule
 	root         rule
+	filename     string
+	config       RegexpConfig
+	mode         CompileMode
+	patterns     []*pattern
+	errs         CompileErrors
+	includes     []string /* scopes of the other grammars included */
+
+	mu      sync.Mutex
+	regexps []*regexp.Regexp
+}
+
+// pattern is a regular expression of a grammar which is compiled on first use.
+type pattern struct {
+	source  string
+	path    string
+	grammar *Grammar
+	once    sync.Once
+	expr    *regexp.Regexp
+	err     *CompileError
+}
+
+// get returns the compiled expression, compiling it if needed.
+func (p *pattern) get() (*regexp.Regexp, *CompileError) {
+	p.once.Do(func() {
+		var err error
+		p.expr, err = p.grammar.compile(p.source)
+		if err != nil {
+			p.err = p.grammar.errorAt(p.path, err)
+		}
+	})
+	return p.expr, p.err
 }
 
 type rule interface {
@@ -72,63 +252,245 @@ type rule interface {
 	// Returns (newTop, advance, err). advance meanings:
 	//
 	//	>0 = number of consumed bytes, 0 = no match, -1 = context switch (include of other grammar).
-	evaluate(offset int, text string, top *StackItem, yield func(*Token), basegrammar *Grammar) (*StackItem, int, error)
+	// param bounds the matching and may be nil.
+	evaluate(offset int, text string, top *StackItem, yield func(*Token), basegrammar *Grammar, param *regexp.MatchParam) (*StackItem, int, error)
 }
 
-// CompileGrammar compiles a decoded GrammarJSON into an executable Grammar.
-// dirname decides where 'source.*' includes are resolved and defaults to `.`; filename is used
-// to strictly validate j.ScopeName ("source.<basename>") and may be omitted.
+// CompileGrammar compiles a decoded GrammarJSON into an executable Grammar. Includes of other
+// scopes are resolved by l when they are evaluated, l also decides the regexp configuration and
+// the CompileMode; l may be nil for a grammar which includes no other scopes.
+// Errors are reported as *CompileError, or as CompileErrors in CompileCollect mode.
 func CompileGrammar(l *Loader, j *GrammarJSON) (*Grammar, error) {
+	mode := CompileLazy
+	if l != nil {
+		mode = l.mode
+	}
+	return CompileGrammarMode(l, j, mode)
+}
+
+// CompileGrammarMode is CompileGrammar compiling in mode rather than the mode of l, which allows
+// to validate a grammar without a loader using CompileCollect.
+func CompileGrammarMode(l *Loader, j *GrammarJSON, mode CompileMode) (*Grammar, error) {
+	j, err := j.decoded()
+	if err != nil {
+		return nil, &CompileError{File: j.filename, Scope: j.ScopeName, Err: err}
+	}
 	res := &Grammar{
 		loader:    l,
+		name:      j.Name,
 		scopeName: j.ScopeName,
 		fileTypes: j.FileTypes,
+		filename:  j.filename,
+		mode:      mode,
+	}
+	if l != nil {
+		res.config = l.regexpConfig(j.ScopeName)
 	}
 	if j.FoldingStart != "" {
-		expr, err := regexp.Compile(j.FoldingStart, 0)
-		if err != nil {
-			return nil, err
-		}
-		res.foldingStart = expr
+		res.foldingStart = res.pattern(j.FoldingStart, "foldingStartMarker")
 	}
 	if j.FoldingEnd != "" {
-		expr, err := regexp.Compile(j.FoldingEnd, 0)
-		if err != nil {
-			return nil, err
-		}
-		res.foldingEnd = expr
+		res.foldingEnd = res.pattern(j.FoldingEnd, "foldingStopMarker")
 	}
 	if j.FirstLine != "" {
-		expr, err := regexp.Compile(j.FirstLine, 0)
-		if err != nil {
+		res.firstLine = res.pattern(j.FirstLine, "firstLineMatch")
+	}
+	if j.sublime != nil {
+		if err := compileSublime(res, j.sublime); err != nil && !res.collect(err) {
 			return nil, err
 		}
-		res.firstLine = expr
+	} else if err := res.compileRoot(j); err != nil {
+		return nil, err
 	}
-	rules := make([]rule, len(j.Patterns))
-	var err error
-	for i, jp := range j.Patterns {
-		rules[i], err = compileRule(res, jp)
-		if err != nil {
-			return nil, err
+
+	switch res.mode {
+	case CompileEager:
+		if errs := res.validate(false); len(errs) > 0 {
+			return nil, errs[0]
+		}
+	case CompileCollect:
+		res.errs = append(res.errs, res.validate(true)...)
+		if len(res.errs) > 0 {
+			return nil, res.errs
 		}
 	}
-	res.root = &expandRule{name: j.ScopeName, rules: rules, grammar: res}
-	res.repository = make(map[string]rule, len(j.Repository))
-	for name, jp := range j.Repository {
-		res.repository[name], err = compileRule(res, jp)
+
+	return res, nil
+}
+
+// compileRoot compiles the patterns and repository of j.
+func (g *Grammar) compileRoot(j *GrammarJSON) error {
+	rules, err := compileRules(g, j.Patterns, "patterns")
+	if err != nil {
+		return err
+	}
+	g.root = &expandRule{name: j.ScopeName, rules: rules, grammar: g}
+	g.repository = make(map[string]rule, len(j.Repository))
+	for _, name := range slices.Sorted(maps.Keys(j.Repository)) {
+		rule, err := compileRule(g, j.Repository[name], jsonPath("repository", name))
 		if err != nil {
-			return nil, err
+			if !g.collect(err) {
+				return err
+			}
+			continue
 		}
+		g.repository[name] = rule
 	}
+	return nil
+}
 
-	return res, nil
+// decoded returns j with its rules, decoding them if only the metadata was decoded. The metadata
+// of j is kept, as it may differ from the file, for example when declared by a manifest.
+func (j *GrammarJSON) decoded() (*GrammarJSON, error) {
+	if j.body == nil {
+		return j, nil
+	}
+	full, err := j.body()
+	if err != nil {
+		return j, err
+	}
+	res := *full
+	res.Name = j.Name
+	res.ScopeName = j.ScopeName
+	res.FileTypes = j.FileTypes
+	res.FirstLine = j.FirstLine
+	res.filename = j.filename
+	res.tier = j.tier
+	res.seq = j.seq
+	res.source = j.source
+	return &res, nil
+}
+
+// include returns a rule including rulename of the grammar named scopename, which is recorded
+// if it is another grammar.
+func (g *Grammar) include(scopename string, rulename string) *includeRule {
+	switch scopename {
+	case "", "$self", "$base", g.scopeName:
+	default:
+		if !slices.Contains(g.includes, scopename) {
+			g.includes = append(g.includes, scopename)
+		}
+	}
+	return &includeRule{scopename: scopename, rulename: rulename, grammar: g}
+}
+
+// Validate compiles every pattern of the grammar which has not been compiled yet,
+// reporting all invalid patterns as CompileErrors.
+func (g *Grammar) Validate() error {
+	if errs := g.validate(true); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validate compiles all patterns, stopping at the first error unless all is set.
+func (g *Grammar) validate(all bool) CompileErrors {
+	var errs CompileErrors
+	for _, p := range g.patterns {
+		if _, err := p.get(); err != nil {
+			errs = append(errs, err)
+			if !all {
+				break
+			}
+		}
+	}
+	return errs
+}
+
+// collect records err in CompileCollect mode and reports whether compilation may continue.
+func (g *Grammar) collect(err error) bool {
+	if g.mode != CompileCollect {
+		return false
+	}
+	var cerr *CompileError
+	if !errors.As(err, &cerr) {
+		cerr = g.errorAt("", err)
+	}
+	g.errs = append(g.errs, cerr)
+	return true
+}
+
+// errorAt attributes err to the rule at path.
+func (g *Grammar) errorAt(path string, err error) *CompileError {
+	return &CompileError{
+		File:  g.filename,
+		Scope: g.scopeName,
+		Path:  path,
+		Err:   err,
+	}
+}
+
+// pattern registers a pattern of this grammar without compiling it, path locates it in the grammar.
+func (g *Grammar) pattern(source string, path string) *pattern {
+	p := &pattern{source: source, path: path, grammar: g}
+	g.patterns = append(g.patterns, p)
+	return p
+}
+
+// compile compiles a pattern owned by this grammar, it is freed by Close.
+func (g *Grammar) compile(pattern string) (*regexp.Regexp, error) {
+	expr, err := regexp.CompileSyntax(pattern, g.config.Options, g.config.Syntax)
+	if err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	g.regexps = append(g.regexps, expr)
+	g.mu.Unlock()
+	return expr, nil
+}
+
+// Close frees all regular expressions of the grammar, it must not be used afterwards.
+// Closing is optional: an unreachable grammar is freed by the garbage collector.
+// A grammar obtained from a loader is dropped from its cache, so that it is compiled again
+// when it is requested next.
+func (g *Grammar) Close() {
+	if g.loader != nil {
+		g.loader.uncache(g)
+	}
+	g.free()
+}
+
+// free frees all regular expressions of the grammar.
+func (g *Grammar) free() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, expr := range g.regexps {
+		expr.Free()
+	}
+	g.regexps = nil
+}
+
+// jsonPath appends key to path, keys which would be ambiguous are quoted: `repository["a.b"]`.
+func jsonPath(path string, key string) string {
+	if key == "" || strings.ContainsAny(key, ".[]\"") {
+		return fmt.Sprintf("%s[%q]", path, key)
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// compileRules compiles the rules of a patterns-list found at path.
+func compileRules(grammar *Grammar, j []RuleJSON, path string) ([]rule, error) {
+	rules := make([]rule, 0, len(j))
+	for i, jp := range j {
+		rule, err := compileRule(grammar, jp, fmt.Sprintf("%s[%d]", path, i))
+		if err != nil {
+			if !grammar.collect(err) {
+				return nil, err
+			}
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
 }
 
 // compileCaptures converts string-indexed captures ("1","2",...) to a slice
 // sized 0..maxIndex, leaving missing indices as nil.
 // Each capture may carry a scope name and/or subrules.
-func compileCaptures(grammar *Grammar, j map[string]RuleJSON) ([]rule, error) {
+func compileCaptures(grammar *Grammar, j map[string]RuleJSON, path string) ([]rule, error) {
 	if j == nil {
 		return nil, nil
 	}
@@ -137,7 +499,7 @@ func compileCaptures(grammar *Grammar, j map[string]RuleJSON) ([]rule, error) {
 	for num := range j {
 		i, err := strconv.Atoi(num)
 		if err != nil {
-			return nil, err
+			return nil, grammar.errorAt(jsonPath(path, num), fmt.Errorf("capture is not a number: %w", err))
 		}
 
 		if i > maxcaptures {
@@ -149,44 +511,37 @@ func compileCaptures(grammar *Grammar, j map[string]RuleJSON) ([]rule, error) {
 	for num, jp := range j {
 		/* already checked if index is number */
 		i, _ := strconv.Atoi(num)
-
-		capture := &matchRule{
-			name:    jp.Name,
-			grammar: grammar,
+		if jp.Disabled {
+			continue
 		}
-		var err error
-		capture.rules = make([]rule, len(jp.Patterns))
-		for i, jp := range jp.Patterns {
-			capture.rules[i], err = compileRule(grammar, jp)
-			if err != nil {
-				return nil, err
-			}
-		}
-		res[i] = capture
+
+		rules, err := compileRules(grammar, jp.Patterns, jsonPath(jsonPath(path, num), "patterns"))
 		if err != nil {
 			return nil, err
 		}
+		res[i] = &matchRule{
+			name:    jp.Name,
+			rules:   rules,
+			grammar: grammar,
+		}
 	}
 	return res, nil
 }
 
-// compileRule compiles a single RuleJSON into a MatchRule.
-// Case order follows TM conventions: Include, Match, Begin/End, Container.
-func compileRule(grammar *Grammar, j RuleJSON) (rule, error) {
+// compileRule compiles a single RuleJSON into a MatchRule, path locates the rule in the grammar.
+// Case order follows TM conventions: Include, Match, Begin/End, Container. A disabled rule
+// compiles to an empty container, which never matches.
+func compileRule(grammar *Grammar, j RuleJSON, path string) (rule, error) {
+	if j.Disabled {
+		return &expandRule{grammar: grammar}, nil
+	}
 	switch {
 	case j.Include != "":
 		scopename, rulename, _ := strings.Cut(j.Include, "#")
-		return &includeRule{
-			scopename: scopename,
-			rulename:  rulename,
-			grammar:   grammar,
-		}, nil
+		return grammar.include(scopename, rulename), nil
 	case j.Match != "":
-		match, err := regexp.Compile(j.Match, 0)
-		if err != nil {
-			return nil, err
-		}
-		captures, err := compileCaptures(grammar, j.Captures)
+		match := grammar.pattern(j.Match, jsonPath(path, "match"))
+		captures, err := compileCaptures(grammar, j.Captures, jsonPath(path, "captures"))
 		if err != nil {
 			return nil, err
 		}
@@ -197,54 +552,43 @@ func compileRule(grammar *Grammar, j RuleJSON) (rule, error) {
 			grammar:  grammar,
 		}, nil
 	case j.Begin != "" && (j.End != "" || j.While != ""):
-		begin, err := regexp.Compile(j.Begin, 0)
-		if err != nil {
-			return nil, err
-		}
-		endptr := j.End
+		begin := grammar.pattern(j.Begin, jsonPath(path, "begin"))
+		var end *pattern
 		whileEnd := false
 		if j.While != "" {
-			endptr = j.While
+			end = grammar.pattern(j.While, jsonPath(path, "while"))
 			whileEnd = true
+		} else {
+			end = grammar.pattern(j.End, jsonPath(path, "end"))
+		}
+		/* `captures` applies to begin and end, unless they have captures of their own */
+		beginCaptures, err := compileCaptures(grammar, j.BeginCaptures, jsonPath(path, "beginCaptures"))
+		if err == nil && j.BeginCaptures == nil {
+			beginCaptures, err = compileCaptures(grammar, j.Captures, jsonPath(path, "captures"))
 		}
-		end, err := regexp.Compile(endptr, 0)
 		if err != nil {
 			return nil, err
 		}
-		var beginCaptures, endCaptures []rule
-		if len(j.Captures) > 0 {
-			captures, err := compileCaptures(grammar, j.BeginCaptures)
-			if err != nil {
-				return nil, err
-			}
-			beginCaptures = captures
-			endCaptures = captures
-		} else {
-			beginCaptures, err = compileCaptures(grammar, j.BeginCaptures)
-			if err != nil {
-				return nil, err
-			}
-			endCaptures, err = compileCaptures(grammar, j.EndCaptures)
-			if err != nil {
-				return nil, err
-			}
+		endCaptures, err := compileCaptures(grammar, j.EndCaptures, jsonPath(path, "endCaptures"))
+		if err == nil && j.EndCaptures == nil {
+			endCaptures, err = compileCaptures(grammar, j.Captures, jsonPath(path, "captures"))
+		}
+		if err != nil {
+			return nil, err
 		}
 
-		rules := make([]rule, len(j.Patterns)+1)
-		rules[0] = &matchRule{
+		rules, err := compileRules(grammar, j.Patterns, jsonPath(path, "patterns"))
+		if err != nil {
+			return nil, err
+		}
+		rules = slices.Insert(rules, 0, rule(&matchRule{
 			name:      j.Name,
 			pattern:   end,
 			captures:  endCaptures,
 			negate:    whileEnd,
 			operation: opPop,
 			grammar:   grammar,
-		}
-		for i, jp := range j.Patterns {
-			rules[i+1], err = compileRule(grammar, jp)
-			if err != nil {
-				return nil, err
-			}
-		}
+		}))
 		return &matchRule{
 			pattern:   begin,
 			captures:  beginCaptures,
@@ -253,15 +597,11 @@ func compileRule(grammar *Grammar, j RuleJSON) (rule, error) {
 			grammar:   grammar,
 		}, nil
 	case j.Begin != "" || j.End != "" || j.While != "":
-		return nil, fmt.Errorf("found rule with begin or end omitted")
+		return nil, grammar.errorAt(path, fmt.Errorf("found rule with begin or end omitted"))
 	default:
-		rules := make([]rule, len(j.Patterns))
-		var err error
-		for i, jp := range j.Patterns {
-			rules[i], err = compileRule(grammar, jp)
-			if err != nil {
-				return nil, err
-			}
+		rules, err := compileRules(grammar, j.Patterns, jsonPath(path, "patterns"))
+		if err != nil {
+			return nil, err
 		}
 		return &expandRule{
 			name:    j.Name,
@@ -0,0 +1,123 @@
+package textmate
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestCompileCollectWithoutLoader(t *testing.T) {
+	j, err := DecodeGrammar([]byte(`{
+		"scopeName": "source.test",
+		"patterns": [{"match": "("}, {"begin": "x"}],
+		"repository": {"a": {"match": "[", "name": "a"}}
+	}`), FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CompileGrammarMode(nil, j, CompileCollect)
+	var errs CompileErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("got %v, want CompileErrors", err)
+	}
+	want := []string{"patterns[1]", "patterns[0].match", "repository.a.match"}
+	got := make(map[string]bool)
+	for _, err := range errs {
+		got[err.Path] = true
+	}
+	for _, path := range want {
+		if !got[path] {
+			t.Errorf("no error at %s in %v", path, errs)
+		}
+	}
+
+	/* without a loader, the grammar is compiled lazily and fails on the first invalid rule */
+	if _, err := CompileGrammar(nil, j); !errors.As(err, new(*CompileError)) {
+		t.Errorf("got %v, want a *CompileError", err)
+	}
+}
+
+func TestBeginEndCaptures(t *testing.T) {
+	tests := []struct {
+		name string
+		rule string
+		want []string
+	}{
+		{"captures", `"captures": {"0": {"name": "p"}}`, []string{"p:(", "p:)"}},
+		{"begin and end", `"beginCaptures": {"0": {"name": "b"}}, "endCaptures": {"0": {"name": "e"}}`, []string{"b:(", "e:)"}},
+		{"begin overrides", `"captures": {"0": {"name": "p"}}, "beginCaptures": {"0": {"name": "b"}}`, []string{"b:(", "p:)"}},
+		{"end overrides", `"captures": {"0": {"name": "p"}}, "endCaptures": {"0": {"name": "e"}}`, []string{"p:(", "e:)"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := compileTest(t, `{"scopeName": "source.test", "patterns": [{"begin": "\\(", "end": "\\)", `+test.rule+`}]}`)
+			got := scopes(t, g, "(x)")
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRuleFlag(t *testing.T) {
+	tests := []struct {
+		format  Format
+		grammar string
+		want    bool
+	}{
+		{FormatJSON, `{"patterns": [{"disabled": 1}]}`, true},
+		{FormatJSON, `{"patterns": [{"disabled": 0}]}`, false},
+		{FormatJSON, `{"patterns": [{"disabled": true}]}`, true},
+		{FormatJSON, `{"patterns": [{"disabled": 0.5}]}`, true},
+		{FormatJSON, `{"patterns": [{"disabled": null}]}`, false},
+		{FormatYAML, "patterns:\n  - disabled: 1\n", true},
+		{FormatYAML, "patterns:\n  - disabled: 0\n", false},
+		{FormatYAML, "patterns:\n  - disabled: -1\n", true},
+		{FormatYAML, "patterns:\n  - disabled: 18446744073709551615\n", true},
+		{FormatYAML, "patterns:\n  - disabled: true\n", true},
+		{FormatPlist, `<plist><dict><key>patterns</key><array><dict><key>disabled</key><integer>1</integer></dict></array></dict></plist>`, true},
+		{FormatPlist, `<plist><dict><key>patterns</key><array><dict><key>disabled</key><integer>-1</integer></dict></array></dict></plist>`, true},
+		{FormatPlist, `<plist><dict><key>patterns</key><array><dict><key>disabled</key><integer>0</integer></dict></array></dict></plist>`, false},
+		{FormatPlist, `<plist><dict><key>patterns</key><array><dict><key>disabled</key><real>1.0</real></dict></array></dict></plist>`, true},
+		{FormatPlist, `<plist><dict><key>patterns</key><array><dict><key>disabled</key><true/></dict></array></dict></plist>`, true},
+	}
+	for _, test := range tests {
+		j, err := DecodeGrammar([]byte(test.grammar), test.format)
+		if err != nil {
+			t.Errorf("%s %s: %v", test.format, test.grammar, err)
+			continue
+		}
+		if got := bool(j.Patterns[0].Disabled); got != test.want {
+			t.Errorf("%s %s: got %v, want %v", test.format, test.grammar, got, test.want)
+		}
+	}
+	for _, format := range []Format{FormatJSON, FormatYAML} {
+		grammar := `{"patterns": [{"disabled": "yes"}]}`
+		if _, err := DecodeGrammar([]byte(grammar), format); err == nil {
+			t.Errorf("%s: string flag decoded without error", format)
+		}
+	}
+}
+
+func TestDisabledRule(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		want  []string
+	}{
+		{"match", `"patterns": [{"match": "x", "name": "x", "disabled": 1}]`, nil},
+		{"begin and end", `"patterns": [{"begin": "x", "end": "y", "name": "b", "disabled": 1}]`, nil},
+		{"named container", `"patterns": [{"name": "c", "disabled": 1, "patterns": [{"match": "x", "name": "x"}]}]`, nil},
+		{"included", `"patterns": [{"include": "#a"}], "repository": {"a": {"match": "x", "name": "x", "disabled": 1}}`, nil},
+		{"capture", `"patterns": [{"match": "(x)y", "name": "m", "captures": {"1": {"name": "x", "disabled": 1}}}]`, []string{"m:xy"}},
+		{"enabled", `"patterns": [{"match": "x", "name": "x", "disabled": 0}]`, []string{"x:x"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := compileTest(t, `{"scopeName": "source.test", `+test.rules+`}`)
+			if got := scopes(t, g, "xy"); !slices.Equal(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package textmate
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"slices"
+)
+
+// Dependencies describes the grammars included by the grammar named Scope, see Loader.Dependencies.
+type Dependencies struct {
+	Scope string
+	// Direct are the scopes included by the grammar itself.
+	Direct []string
+	// Transitive are the scopes included by the grammar or by the grammars it includes.
+	Transitive []string
+	// Missing are the scopes of Transitive which no grammar is registered for.
+	Missing []string
+	// Err reports grammars which failed to compile, their dependencies are not listed.
+	Err error
+}
+
+// Dependencies walks the includes of the grammar named scope and of the grammars it includes,
+// which are compiled to do so. Scopes are listed in sorted order.
+func (l *Loader) Dependencies(scope string) (Dependencies, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.winner(scope) == nil {
+		return Dependencies{}, os.ErrNotExist
+	}
+	return l.dependencies(scope), nil
+}
+
+// DependencyGraph returns the dependencies of every registered grammar, ordered by scope.
+func (l *Loader) DependencyGraph() []Dependencies {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var res []Dependencies
+	for _, scope := range slices.Sorted(maps.Keys(l.scopes)) {
+		res = append(res, l.dependencies(scope))
+	}
+	return res
+}
+
+// dependencies walks the includes of the grammar named scope, l.mu must be held.
+func (l *Loader) dependencies(scope string) Dependencies {
+	res := Dependencies{Scope: scope}
+	var errs []error
+	direct, err := l.includes(scope)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	res.Direct = direct
+
+	seen := map[string]bool{scope: true}
+	queue := slices.Clone(direct)
+	for len(queue) > 0 {
+		dep := queue[0]
+		queue = queue[1:]
+		if seen[dep] {
+			continue
+		}
+		seen[dep] = true
+		res.Transitive = append(res.Transitive, dep)
+		if l.winner(dep) == nil {
+			res.Missing = append(res.Missing, dep)
+			continue
+		}
+		deps, err := l.includes(dep)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		queue = append(queue, deps...)
+	}
+	slices.Sort(res.Transitive)
+	slices.Sort(res.Missing)
+	res.Err = errors.Join(errs...)
+	return res
+}
+
+// includes returns the scopes included by the grammar named scope, l.mu must be held.
+func (l *Loader) includes(scope string) ([]string, error) {
+	comp, err := l.load(l.winner(scope))
+	if err != nil {
+		return nil, err
+	}
+	return comp.Dependencies(), nil
+}
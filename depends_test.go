@@ -0,0 +1,66 @@
+package textmate
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestDependencies(t *testing.T) {
+	l, _ := NewLoader(nil)
+	grammars := []string{
+		`{"scopeName": "source.a", "patterns": [{"include": "source.b"}, {"include": "source.b#x"}]}`,
+		`{"scopeName": "source.b", "patterns": [{"include": "source.c"}, {"include": "source.missing"}], "repository": {"x": {"include": "source.c"}}}`,
+		/* the cycle back to source.a ends the walk */
+		`{"scopeName": "source.c", "patterns": [{"include": "source.a"}, {"include": "$self"}, {"include": "#y"}], "repository": {"y": {"match": "y"}}}`,
+		`{"scopeName": "source.self", "patterns": [{"include": "source.self"}, {"include": "$base"}]}`,
+		`{"scopeName": "source.broken", "patterns": [{"include": "source.a"}, {"begin": "x"}]}`,
+		`{"scopeName": "source.uses", "patterns": [{"include": "source.broken"}]}`,
+	}
+	for _, grammar := range grammars {
+		if err := l.Register([]byte(grammar), FormatJSON); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		scope      string
+		direct     []string
+		transitive []string
+		missing    []string
+		err        bool
+	}{
+		{"source.a", []string{"source.b"}, []string{"source.b", "source.c", "source.missing"}, []string{"source.missing"}, false},
+		{"source.b", []string{"source.c", "source.missing"}, []string{"source.a", "source.c", "source.missing"}, []string{"source.missing"}, false},
+		{"source.c", []string{"source.a"}, []string{"source.a", "source.b", "source.missing"}, []string{"source.missing"}, false},
+		{"source.self", nil, nil, nil, false},
+		{"source.broken", nil, nil, nil, true},
+		/* the dependencies of grammars which fail to compile are not listed */
+		{"source.uses", []string{"source.broken"}, []string{"source.broken"}, nil, true},
+	}
+	for _, test := range tests {
+		deps, err := l.Dependencies(test.scope)
+		if err != nil {
+			t.Fatalf("%s: %v", test.scope, err)
+		}
+		if !slices.Equal(deps.Direct, test.direct) || !slices.Equal(deps.Transitive, test.transitive) || !slices.Equal(deps.Missing, test.missing) {
+			t.Errorf("%s: got %+v, want direct %q, transitive %q, missing %q", test.scope, deps, test.direct, test.transitive, test.missing)
+		}
+		if (deps.Err != nil) != test.err {
+			t.Errorf("%s: got error %v", test.scope, deps.Err)
+		}
+	}
+
+	if _, err := l.Dependencies("source.missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing scope: got %v, want os.ErrNotExist", err)
+	}
+
+	var got []string
+	for _, deps := range l.DependencyGraph() {
+		got = append(got, deps.Scope)
+	}
+	want := []string{"source.a", "source.b", "source.broken", "source.c", "source.self", "source.uses"}
+	if !slices.Equal(got, want) {
+		t.Errorf("DependencyGraph lists %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,238 @@
+package textmate
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheVersion is increased whenever the encoding of cached grammars changes.
+const cacheVersion = 2
+
+// WithCache keeps an index of the grammar files read from disk in the file at path, which is
+// created if needed. A file whose path, size and modification time match the index is not read
+// at all: its metadata is taken from the index and its rules are decoded from the index when
+// the grammar is first compiled. Grammars from archives or other filesystems are not cached.
+func WithCache(path string) LoaderOption {
+	return func(l *Loader) {
+		l.disk = &diskCache{path: path}
+	}
+}
+
+// diskCache is the index of grammar files kept by WithCache.
+type diskCache struct {
+	path    string
+	entries map[string]*cacheEntry
+	dirty   bool
+}
+
+type cacheFile struct {
+	Version int
+	Entries map[string]*cacheEntry
+}
+
+// cacheEntry is a grammar file, Header carries the metadata and Body the encoded grammar.
+type cacheEntry struct {
+	Size    int64
+	ModTime time.Time
+	Header  GrammarJSON
+	Sublime bool
+	Body    []byte
+}
+
+// dirFS is os.DirFS which remembers its directory, so that files can be cached by their path.
+type dirFS struct {
+	fs.FS
+	dir string
+}
+
+func newDirFS(dir string) dirFS {
+	return dirFS{os.DirFS(dir), dir}
+}
+
+// osPath returns the operating system path of name in fsys, ok is false if fsys is not on disk.
+func osPath(fsys fs.FS, name string) (string, bool) {
+	var pathname string
+	switch fsys := fsys.(type) {
+	case osFS:
+		pathname = name
+	case dirFS:
+		pathname = filepath.Join(fsys.dir, filepath.FromSlash(name))
+	default:
+		return "", false
+	}
+	pathname, err := filepath.Abs(pathname)
+	return pathname, err == nil
+}
+
+// open reads the index, a missing or outdated index is started anew.
+func (c *diskCache) open() {
+	if c.entries != nil {
+		return
+	}
+	c.entries = make(map[string]*cacheEntry)
+	content, err := os.ReadFile(c.path)
+	if err != nil {
+		return
+	}
+	var file cacheFile
+	if gob.NewDecoder(bytes.NewReader(content)).Decode(&file) == nil && file.Version == cacheVersion {
+		c.entries = file.Entries
+	}
+}
+
+// lookup returns the header of the grammar at pathname if it is unchanged since it was stored.
+func (c *diskCache) lookup(pathname string, info fs.FileInfo) *GrammarJSON {
+	c.open()
+	entry, ok := c.entries[pathname]
+	if !ok || entry.Size != info.Size() || !entry.ModTime.Equal(info.ModTime()) {
+		return nil
+	}
+	grm := entry.Header
+	grm.FileTypes = append([]string(nil), grm.FileTypes...)
+	body, sublime := entry.Body, entry.Sublime
+	grm.body = func() (*GrammarJSON, error) {
+		return decodeCached(body, sublime)
+	}
+	return &grm
+}
+
+// store records the grammar at pathname.
+func (c *diskCache) store(pathname string, info fs.FileInfo, grm *GrammarJSON) error {
+	var body bytes.Buffer
+	var err error
+	if grm.sublime != nil {
+		err = gob.NewEncoder(&body).Encode(grm.sublime)
+	} else {
+		err = gob.NewEncoder(&body).Encode(grm)
+	}
+	if err != nil {
+		return err
+	}
+	c.open()
+	c.entries[pathname] = &cacheEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Header: GrammarJSON{
+			Name:      grm.Name,
+			ScopeName: grm.ScopeName,
+			FileTypes: grm.FileTypes,
+			FirstLine: grm.FirstLine,
+		},
+		Sublime: grm.sublime != nil,
+		Body:    body.Bytes(),
+	}
+	c.dirty = true
+	return nil
+}
+
+// save writes the index if it changed, entries of files which were removed are dropped.
+func (c *diskCache) save() error {
+	if !c.dirty {
+		return nil
+	}
+	for pathname := range c.entries {
+		if _, err := os.Stat(pathname); err != nil {
+			delete(c.entries, pathname)
+		}
+	}
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(cacheFile{Version: cacheVersion, Entries: c.entries}); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	/* written aside first, so that concurrent loaders never read a partial index */
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(content.Bytes())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// decodeCached decodes the body of a cache entry.
+func decodeCached(body []byte, sublime bool) (*GrammarJSON, error) {
+	dec := gob.NewDecoder(bytes.NewReader(body))
+	if sublime {
+		var syntax SublimeSyntax
+		if err := dec.Decode(&syntax); err != nil {
+			return nil, err
+		}
+		return syntax.GrammarJSON(), nil
+	}
+	var grm GrammarJSON
+	if err := dec.Decode(&grm); err != nil {
+		return nil, err
+	}
+	return &grm, nil
+}
+
+// loadFile decodes the grammar named name in fsys like loadFile, using the cache if there is one,
+// and records the file for Reload. Files missing from the cache are decoded fully in order to be stored.
+func (l *Loader) loadFile(fsys fs.FS, name string, pathname string) (*GrammarJSON, error) {
+	info, err := fs.Stat(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	grm, err := l.decodeFile(fsys, name, pathname, info)
+	if err != nil {
+		return nil, err
+	}
+	grm.source = &fileSource{fsys: fsys, name: name, size: info.Size(), modTime: info.ModTime(), archive: l.archive}
+	if l.strict {
+		l.checkKeys(fsys, name, pathname, grm.ScopeName)
+	}
+	return grm, nil
+}
+
+// decodeFile decodes the grammar named name in fsys, whose file is described by info.
+func (l *Loader) decodeFile(fsys fs.FS, name string, pathname string, info fs.FileInfo) (*GrammarJSON, error) {
+	ospath, ok := osPath(fsys, name)
+	if l.disk == nil || !ok {
+		if l.lazy {
+			return loadHeader(fsys, name, pathname)
+		}
+		return loadFile(fsys, name, pathname)
+	}
+	if grm := l.disk.lookup(ospath, info); grm != nil {
+		grm.filename = pathname
+		return grm, nil
+	}
+	grm, err := loadFile(fsys, name, pathname)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.disk.store(ospath, info, grm); err != nil {
+		l.diagnose(Diagnostic{Path: pathname, Err: err})
+	}
+	return grm, nil
+}
+
+// saveCache writes the cache if there is one, problems are reported as diagnostics.
+func (l *Loader) saveCache() {
+	if l.disk == nil {
+		return
+	}
+	if err := l.disk.save(); err != nil {
+		l.diagnose(Diagnostic{Path: l.disk.path, Err: err})
+	}
+}
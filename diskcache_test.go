@@ -0,0 +1,105 @@
+package textmate
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	grammars := filepath.Join(dir, "grammars")
+	cache := filepath.Join(dir, "cache", "grammars.cache")
+	file := filepath.Join(grammars, "test.tmLanguage.json")
+	if err := os.Mkdir(grammars, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(testGrammar), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		change func()
+		cached bool
+		want   string /* name of the grammar */
+	}{
+		{"miss", nil, false, ""},
+		{"hit", nil, true, ""},
+		{"changed", func() {
+			content := `{"name": "Changed", "scopeName": "source.test", "patterns": [{"match": "if", "name": "keyword"}]}`
+			os.WriteFile(file, []byte(content), 0o644)
+		}, false, "Changed"},
+		{"hit after change", nil, true, "Changed"},
+		{"touched", func() {
+			later := time.Now().Add(time.Hour)
+			os.Chtimes(file, later, later)
+		}, false, "Changed"},
+	}
+	for _, test := range tests {
+		if test.change != nil {
+			test.change()
+		}
+		l, ok := NewLoaderFromDir(grammars, false, WithCache(cache))
+		if !ok || len(l.Diagnostics()) > 0 {
+			t.Fatalf("%s: no grammars loaded: %v", test.name, l.Diagnostics())
+		}
+		grm := l.winner("source.test")
+		if cached := grm.body != nil; cached != test.cached {
+			t.Errorf("%s: cached = %v, want %v", test.name, cached, test.cached)
+		}
+		g, err := l.FromScope("source.test")
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if g.Name() != test.want {
+			t.Errorf("%s: name %q, want %q", test.name, g.Name(), test.want)
+		}
+		if got := scopes(t, g, "if"); len(got) != 1 {
+			t.Errorf("%s: got %q, want a keyword", test.name, got)
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(cache))
+	if err != nil || len(entries) != 1 {
+		t.Errorf("cache directory holds %v, %v; want only the cache", entries, err)
+	}
+}
+
+func TestDiskCacheConcurrentSave(t *testing.T) {
+	dir := t.TempDir()
+	cache := filepath.Join(dir, "grammars.cache")
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grm, err := DecodeGrammar([]byte(testGrammar), FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := &diskCache{path: cache}
+			if err := c.store(dir, info, grm); err != nil {
+				t.Error(err)
+			}
+			if err := c.save(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	c := &diskCache{path: cache}
+	if c.lookup(dir, info) == nil {
+		t.Error("entry is missing from the cache")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary files are left: %v", entries)
+	}
+}
@@ -0,0 +1,169 @@
+package textmate
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// association uses the grammar named scope for files matching pattern.
+type association struct {
+	pattern string
+	scope   string
+}
+
+// fileGlob is a file name pattern declared for a grammar, such as `filenamePatterns` of an extension.
+type fileGlob struct {
+	pattern string
+	scope   string
+}
+
+// WithAssociation uses the grammar named scope for files matching pattern, see Loader.Associate.
+func WithAssociation(pattern string, scope string) LoaderOption {
+	return func(l *Loader) {
+		l.associations = append(l.associations, association{pattern, scope})
+	}
+}
+
+// Associate uses the grammar named scope for files matching pattern, regardless of the grammars
+// declaring the file. The pattern is matched as by path.Match against the base name of the file,
+// or against the whole path if it contains a slash; a leading `**/` matches any directory and
+// `{a,b}` matches either alternative. Later associations take precedence.
+func (l *Loader) Associate(pattern string, scope string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.associations = append(l.associations, association{pattern, scope})
+}
+
+// FromFileName returns the grammar for the file at name, which is resolved in order by:
+//
+//  1. associations, see Associate;
+//  2. the exact file name (`Makefile`, `CMakeLists.txt`), see isFileName;
+//  3. the extensions, longest first (`d.ts` before `ts` for `index.d.ts`, `bashrc` for `.bashrc`);
+//  4. file name patterns declared in extension manifests.
+//
+// A name without a dot has no extension: a file named `json` is not taken for a JSON file.
+func (l *Loader) FromFileName(name string) (*Grammar, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, scope, ft := l.resolveFileName(name)
+	if ft != "" {
+		scope = l.filetypes[ft][0]
+	}
+	grm := l.winner(scope)
+	if grm == nil {
+		return nil, os.ErrNotExist
+	}
+	return l.load(grm)
+}
+
+// resolveFileName finds the grammar for the file at name, which is either the grammar named
+// scope or the first for file type ft. match describes the rule which applied, l.mu must be held.
+func (l *Loader) resolveFileName(name string) (match string, scope string, ft string) {
+	name = filepath.ToSlash(name)
+	for i := len(l.associations) - 1; i >= 0; i-- {
+		assoc := l.associations[i]
+		if l.winner(assoc.scope) != nil && matchGlob(assoc.pattern, name) {
+			return fmt.Sprintf("association `%s`", assoc.pattern), assoc.scope, ""
+		}
+	}
+
+	base := path.Base(name)
+	/* file types are indexed without leading dot */
+	for _, ft := range []string{base, strings.TrimLeft(base, ".")} {
+		if _, ok := l.filetypes[ft]; ok && l.filenames[ft] {
+			return fmt.Sprintf("file name `%s`", base), "", ft
+		}
+	}
+	for i := 0; i < len(base)-1; i++ {
+		if base[i] != '.' {
+			continue
+		}
+		ext := base[i+1:]
+		for _, ft := range []string{ext, strings.ToLower(ext)} {
+			if _, ok := l.filetypes[ft]; ok {
+				return fmt.Sprintf("extension `%s`", ft), "", ft
+			}
+		}
+	}
+
+	for _, glob := range l.globs {
+		if l.winner(glob.scope) != nil && matchGlob(glob.pattern, name) {
+			return fmt.Sprintf("pattern `%s`", glob.pattern), glob.scope, ""
+		}
+	}
+	return "", "", ""
+}
+
+// isFileName reports whether the file type ft names whole files rather than an extension, which
+// is assumed if it contains a dot or an upper-case letter: `Makefile` or `CMakeLists.txt`, but not
+// `makefile`. File names declared by extension manifests are known to be names.
+func isFileName(ft string) bool {
+	return strings.Contains(ft, ".") || strings.ToLower(ft) != ft
+}
+
+// matchGlob reports whether the slash-separated name matches pattern, see Loader.Associate.
+func matchGlob(pattern string, name string) bool {
+	for _, alt := range expandBraces(pattern) {
+		if matchPath(alt, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandBraces returns the patterns which pattern stands for, in which `{a,b}` is either `a` or `b`.
+// Unbalanced braces are taken literally.
+func expandBraces(pattern string) []string {
+	start := strings.IndexByte(pattern, '{')
+	if start == -1 {
+		return []string{pattern}
+	}
+	var alts []string
+	depth, last := 0, start+1
+	for i := start; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '{':
+			depth++
+		case ',':
+			if depth == 1 {
+				alts = append(alts, pattern[last:i])
+				last = i + 1
+			}
+		case '}':
+			depth--
+			if depth > 0 {
+				continue
+			}
+			alts = append(alts, pattern[last:i])
+			var res []string
+			for _, alt := range alts {
+				res = append(res, expandBraces(pattern[:start]+alt+pattern[i+1:])...)
+			}
+			return res
+		}
+	}
+	return []string{pattern}
+}
+
+// matchPath reports whether name matches pattern, which has no braces.
+func matchPath(pattern string, name string) bool {
+	pattern, anydir := strings.CutPrefix(pattern, "**/")
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(name))
+		return ok
+	}
+	if ok, _ := path.Match(pattern, name); ok || !anydir {
+		return ok
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] == '/' {
+			if ok, _ := path.Match(pattern, name[i+1:]); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
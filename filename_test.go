@@ -0,0 +1,103 @@
+package textmate
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"*.h", "include/vector.h", true},
+		{"*.h", "vector.hpp", false},
+		{"include/*.h", "include/vector.h", true},
+		{"include/*.h", "src/include/vector.h", false},
+		{"**/include/*.h", "src/include/vector.h", true},
+		{"**/include/*.h", "include/vector.h", true},
+		{"*.{c,h}", "main.c", true},
+		{"*.{c,h}", "main.h", true},
+		{"*.{c,h}", "main.cc", false},
+		{"{Makefile,*.mk}", "rules.mk", true},
+		{"*.{c{,c,pp},h}", "main.cpp", true},
+		{"*.{c{,c,pp},h}", "main.cxx", false},
+		{"{a,b}/{c,d}.txt", "b/c.txt", true},
+		{"*.{c", "main.{c", true},
+	}
+	for _, test := range tests {
+		if got := matchGlob(test.pattern, test.name); got != test.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", test.pattern, test.name, got, test.want)
+		}
+	}
+}
+
+func TestExpandBraces(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"*.go", []string{"*.go"}},
+		{"*.{c,h}", []string{"*.c", "*.h"}},
+		{"{a,b}{1,2}", []string{"a1", "a2", "b1", "b2"}},
+		{"x{a,{b,c}}", []string{"xa", "xb", "xc"}},
+		{"{}", []string{""}},
+		{"{a", []string{"{a"}},
+	}
+	for _, test := range tests {
+		if got := expandBraces(test.pattern); !slices.Equal(got, test.want) {
+			t.Errorf("expandBraces(%q) = %q, want %q", test.pattern, got, test.want)
+		}
+	}
+}
+
+func TestFromFileName(t *testing.T) {
+	l, _ := NewLoader(nil)
+	for scope, fileTypes := range map[string]string{
+		"source.json":     `["json"]`,
+		"source.makefile": `["Makefile", "makefile", "mk"]`,
+		"source.ts":       `["ts"]`,
+		"source.dts":      `["d.ts"]`,
+		"source.shell":    `["sh", ".bashrc"]`,
+		"source.cmake":    `["CMakeLists.txt", "cmake"]`,
+		"source.c":        `["c"]`,
+	} {
+		content := fmt.Sprintf(`{"scopeName": %q, "fileTypes": %s}`, scope, fileTypes)
+		if err := l.Register([]byte(content), FormatJSON); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Associate("*.{h,hh}", "source.c")
+
+	tests := []struct {
+		name string
+		want string /* scope, empty if no grammar is found */
+	}{
+		{"config.json", "source.json"},
+		{"CONFIG.JSON", "source.json"},
+		{"json", ""},
+		{"dir/json", ""},
+		{"Makefile", "source.makefile"},
+		{"rules.mk", "source.makefile"},
+		{"makefile", ""},
+		{"index.d.ts", "source.dts"},
+		{"index.ts", "source.ts"},
+		{".bashrc", "source.shell"},
+		{"bashrc", ""},
+		{"CMakeLists.txt", "source.cmake"},
+		{"src/main.h", "source.c"},
+		{"src/main.hh", "source.c"},
+		{"file.", ""},
+	}
+	for _, test := range tests {
+		var got string
+		if g, err := l.FromFileName(test.name); err == nil {
+			got = g.ScopeName()
+		}
+		if got != test.want {
+			t.Errorf("FromFileName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
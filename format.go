@@ -0,0 +1,208 @@
+package textmate
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+	"howett.net/plist"
+)
+
+// Format is an encoding grammars are written in.
+type Format int
+
+const (
+	// FormatUnknown is returned by DetectFormat for content which is not a grammar.
+	FormatUnknown Format = iota - 1
+	FormatJSON
+	FormatPlist
+	FormatYAML
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatJSON:
+		return "json"
+	case FormatPlist:
+		return "plist"
+	case FormatYAML:
+		return "yaml"
+	case FormatUnknown:
+		return "unknown"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// ErrUnknownFormat is returned when decoding content which is not JSON, plist or YAML.
+var ErrUnknownFormat = errors.New("unknown format")
+
+// ErrNotEncodable is returned when encoding a grammar imported from a Sublime syntax, whose
+// contexts have no TextMate equivalent.
+var ErrNotEncodable = errors.New("grammar is a Sublime syntax and cannot be encoded")
+
+// ParseFormat returns the format named name, as returned by Format.String.
+func ParseFormat(name string) (Format, error) {
+	for _, f := range []Format{FormatJSON, FormatPlist, FormatYAML} {
+		if strings.EqualFold(name, f.String()) {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown format `%s`", name)
+}
+
+// DetectFormat determines the format of content by its first bytes. The extension of name
+// is only consulted if the content is ambiguous, name may be empty. Content is only taken for
+// YAML if it starts with a `%YAML` directive, a document marker or a key, otherwise the format
+// is FormatUnknown.
+func DetectFormat(name string, content []byte) Format {
+	content = bytes.TrimPrefix(content, []byte("\xef\xbb\xbf"))
+	content = bytes.TrimLeft(content, " \t\r\n")
+	name = strings.ToLower(name)
+	switch {
+	case bytes.HasPrefix(content, []byte("bplist")), bytes.HasPrefix(content, []byte("<")):
+		return FormatPlist
+	case bytes.HasPrefix(content, []byte("{")):
+		/* old-style plists are enclosed in braces as well */
+		if strings.HasSuffix(name, ".tmlanguage") || strings.HasSuffix(name, ".plist") {
+			return FormatPlist
+		}
+		return FormatJSON
+	case bytes.HasPrefix(content, []byte("[")):
+		return FormatJSON
+	}
+	for line := range bytes.Lines(content) {
+		line = bytes.TrimRight(line, " \t\r\n")
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if bytes.HasPrefix(line, []byte("%YAML")) || bytes.HasPrefix(line, []byte("---")) || isYAMLKey(line) {
+			return FormatYAML
+		}
+		break
+	}
+	return FormatUnknown
+}
+
+// isYAMLKey reports whether line starts a mapping at the top level of a YAML document.
+func isYAMLKey(line []byte) bool {
+	key, rest, ok := bytes.Cut(line, []byte(":"))
+	if !ok || len(key) == 0 || bytes.ContainsAny(key[:1], " \t-") {
+		return false
+	}
+	return len(rest) == 0 || rest[0] == ' ' || rest[0] == '\t'
+}
+
+// unknownFormat is the error for decoding content in a format other than JSON, plist or YAML.
+func unknownFormat(format Format) error {
+	if format == FormatUnknown {
+		return ErrUnknownFormat
+	}
+	return fmt.Errorf("%w %v", ErrUnknownFormat, format)
+}
+
+// DecodeGrammar decodes a grammar written in format.
+func DecodeGrammar(content []byte, format Format) (*GrammarJSON, error) {
+	var encoded GrammarJSON
+	var err error
+	switch format {
+	case FormatJSON:
+		err = json.Unmarshal(content, &encoded)
+	case FormatPlist:
+		_, err = plist.Unmarshal(content, &encoded)
+	case FormatYAML:
+		err = yaml.Unmarshal(stripYAMLDirective(content), &encoded)
+	default:
+		err = unknownFormat(format)
+	}
+	return &encoded, err
+}
+
+// EncodeGrammar writes g in format. The output is stable: in JSON and YAML the keys of rules
+// are written in the order of GrammarJSON and RuleJSON, in plists all keys are sorted. Map keys
+// such as repository names are sorted in every format. Empty fields are omitted.
+func EncodeGrammar(w io.Writer, g *GrammarJSON, format Format) error {
+	if g.sublime != nil {
+		return ErrNotEncodable
+	}
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "\t")
+		return enc.Encode(g)
+	case FormatPlist:
+		enc := plist.NewEncoderForFormat(w, plist.XMLFormat)
+		enc.Indent("\t")
+		if err := enc.Encode(g); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, "\n")
+		return err
+	case FormatYAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(g); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+	return unknownFormat(format)
+}
+
+// grammarHeader is the metadata of a grammar, which is decoded without its rules.
+type grammarHeader struct {
+	Name      string   `json:"name" plist:"name" yaml:"name"`
+	ScopeName string   `json:"scopeName" plist:"scopeName" yaml:"scopeName"`
+	FileTypes []string `json:"fileTypes" plist:"fileTypes" yaml:"fileTypes"`
+	FirstLine string   `json:"firstLineMatch" plist:"firstLineMatch" yaml:"firstLineMatch"`
+}
+
+// sublimeHeader is the metadata of a Sublime syntax, see grammarHeader.
+type sublimeHeader struct {
+	Name           string   `yaml:"name"`
+	Scope          string   `yaml:"scope"`
+	FileExtensions []string `yaml:"file_extensions"`
+	FirstLineMatch string   `yaml:"first_line_match"`
+}
+
+// decodeHeader decodes only the metadata of a grammar written in format, or of a Sublime syntax.
+func decodeHeader(content []byte, format Format, sublime bool) (*GrammarJSON, error) {
+	if sublime {
+		var header sublimeHeader
+		if err := yaml.Unmarshal(stripYAMLDirective(content), &header); err != nil {
+			return nil, err
+		}
+		return &GrammarJSON{Name: header.Name, ScopeName: header.Scope, FileTypes: header.FileExtensions, FirstLine: header.FirstLineMatch}, nil
+	}
+	var header grammarHeader
+	var err error
+	switch format {
+	case FormatJSON:
+		err = json.Unmarshal(content, &header)
+	case FormatPlist:
+		_, err = plist.Unmarshal(content, &header)
+	case FormatYAML:
+		err = yaml.Unmarshal(stripYAMLDirective(content), &header)
+	default:
+		err = unknownFormat(format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &GrammarJSON{Name: header.Name, ScopeName: header.ScopeName, FileTypes: header.FileTypes, FirstLine: header.FirstLine}, nil
+}
+
+// stripYAMLDirective removes a leading `%YAML 1.2` directive, the decoder rejects any
+// version other than 1.1 although the documents are compatible.
+func stripYAMLDirective(content []byte) []byte {
+	trimmed := bytes.TrimPrefix(content, []byte("\xef\xbb\xbf"))
+	if !bytes.HasPrefix(trimmed, []byte("%YAML")) {
+		return content
+	}
+	_, rest, _ := bytes.Cut(trimmed, []byte("\n"))
+	return rest
+}
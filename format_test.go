@@ -0,0 +1,116 @@
+package textmate
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    Format
+	}{
+		{"a.json", `{"scopeName": "source.a"}`, FormatJSON},
+		{"a.json", "\xef\xbb\xbf\n  [1]", FormatJSON},
+		{"a.tmLanguage", `{ scopeName = "source.a"; }`, FormatPlist},
+		{"a.tmLanguage", `<?xml version="1.0"?>`, FormatPlist},
+		{"a", "bplist00", FormatPlist},
+		{"a.yaml", "%YAML 1.2\n---\nname: a", FormatYAML},
+		{"a.yaml", "---\nname: a", FormatYAML},
+		{"a.yaml", "# comment\n\nscopeName: source.a\n", FormatYAML},
+		{"a.yaml", `"scopeName": source.a`, FormatYAML},
+		{"a.yaml", "patterns:\n  - match: a", FormatYAML},
+		{"README", "Some text\nscopeName: a", FormatUnknown},
+		{"a.txt", "http://example.com", FormatUnknown},
+		{"a.yaml", "- a\n- b", FormatUnknown},
+		{"empty", "", FormatUnknown},
+	}
+	for _, test := range tests {
+		if got := DetectFormat(test.name, []byte(test.content)); got != test.want {
+			t.Errorf("%s %q: got %v, want %v", test.name, test.content, got, test.want)
+		}
+	}
+	if _, err := DecodeGrammar([]byte("text"), DetectFormat("", []byte("text"))); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("got %v, want ErrUnknownFormat", err)
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	orig := []byte(`{
+		"name": "Test",
+		"scopeName": "source.test",
+		"fileTypes": ["test"],
+		"firstLineMatch": "^#!.*test",
+		"patterns": [
+			{"include": "#string"},
+			{"match": "\\b(if)\\b", "name": "keyword", "captures": {"1": {"name": "control"}}, "comment": "keywords"},
+			{"match": "x", "disabled": 1}
+		],
+		"repository": {
+			"string": {"begin": "\"", "end": "\"", "name": "string", "endCaptures": {"0": {"name": "end"}}, "patterns": [{"match": "\\\\."}]},
+			"a.b": {"while": "^>", "begin": ">"}
+		}
+	}`)
+	j, err := DecodeGrammar(orig, FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	if err := EncodeGrammar(&want, j, FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	for _, format := range []Format{FormatJSON, FormatPlist, FormatYAML} {
+		var buf bytes.Buffer
+		if err := EncodeGrammar(&buf, j, format); err != nil {
+			t.Fatalf("encode %v: %v", format, err)
+		}
+		if got := DetectFormat("", buf.Bytes()); got != format {
+			t.Errorf("encoded %v is detected as %v", format, got)
+		}
+		decoded, err := DecodeGrammar(buf.Bytes(), format)
+		if err != nil {
+			t.Fatalf("decode %v: %v", format, err)
+		}
+		var got bytes.Buffer
+		if err := EncodeGrammar(&got, decoded, FormatJSON); err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != want.String() {
+			t.Errorf("%v round trip:\n%s\nwant:\n%s", format, got.String(), want.String())
+		}
+	}
+	if dropped, err := DroppedKeys(orig, FormatJSON); err != nil || len(dropped) != 0 {
+		t.Errorf("DroppedKeys = %v, %v", dropped, err)
+	}
+}
+
+func TestDroppedKeys(t *testing.T) {
+	content := []byte(`{
+		"scopeName": "source.test",
+		"uuid": "1",
+		"comment": "grammar",
+		"injections": {},
+		"patterns": [{"begin": "a", "end": "b", "contentName": "inner", "applyEndPatternLast": 1, "comment": "kept"}]
+	}`)
+	dropped, err := DroppedKeys(content, FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]error{
+		"uuid":                            ErrIgnoredKey,
+		"comment":                         ErrIgnoredKey,
+		"injections":                      ErrUnsupportedKey,
+		"patterns[0].contentName":         ErrUnsupportedKey,
+		"patterns[0].applyEndPatternLast": ErrUnsupportedKey,
+	}
+	if len(dropped) != len(want) {
+		t.Fatalf("got %v, want %d keys", dropped, len(want))
+	}
+	for _, keyErr := range dropped {
+		if !errors.Is(keyErr, want[keyErr.Path]) {
+			t.Errorf("%s: got %v, want %v", keyErr.Path, keyErr.Err, want[keyErr.Path])
+		}
+	}
+}
@@ -2,4 +2,7 @@ module github.com/friedelschoen/go-textmate
 
 go 1.24
 
-require howett.net/plist v1.0.1
+require (
+	go.yaml.in/yaml/v3 v3.0.4
+	howett.net/plist v1.0.1
+)
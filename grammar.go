@@ -0,0 +1,46 @@
+package textmate
+
+import (
+	"maps"
+	"slices"
+)
+
+// Name returns the display name of the grammar, such as `JavaScript`.
+func (g *Grammar) Name() string {
+	return g.name
+}
+
+// ScopeName returns the scope of the grammar, such as `source.js`.
+func (g *Grammar) ScopeName() string {
+	return g.scopeName
+}
+
+// FileTypes returns the file extensions and names the grammar is declared for.
+func (g *Grammar) FileTypes() []string {
+	return slices.Clone(g.fileTypes)
+}
+
+// FirstLineMatch returns the pattern recognizing files by their first line, empty if there is none.
+func (g *Grammar) FirstLineMatch() string {
+	if g.firstLine == nil {
+		return ""
+	}
+	return g.firstLine.source
+}
+
+// FileName returns the file the grammar was loaded from, empty if it was not loaded from a file.
+func (g *Grammar) FileName() string {
+	return g.filename
+}
+
+// RepositoryNames returns the names of the rules in the repository in sorted order, which are
+// included as `#name`. For a Sublime syntax these are its contexts.
+func (g *Grammar) RepositoryNames() []string {
+	return slices.Sorted(maps.Keys(g.repository))
+}
+
+// Dependencies returns the scopes of the other grammars included by this grammar in sorted
+// order, whether the loader knows them or not.
+func (g *Grammar) Dependencies() []string {
+	return slices.Sorted(slices.Values(g.includes))
+}
@@ -0,0 +1,247 @@
+package textmate
+
+import (
+	"cmp"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Language is a language known to the loader, declared by an extension manifest or derived from
+// a grammar. Its grammar is named by Scope, which is empty if no grammar was loaded for it.
+type Language struct {
+	// ID identifies the language, such as `go` or `cpp`.
+	ID string
+	// Name is the display name.
+	Name       string
+	Aliases    []string
+	Extensions []string
+	Filenames  []string
+	MimeTypes  []string
+	Scope      string
+}
+
+// languageAliases are well-known names of languages, the first of each being the identifier
+// VS Code uses. Languages with any of these identifiers get the others as aliases. Names which
+// are commonly used for several languages, such as `pl` or `ml`, are left out.
+var languageAliases = [][]string{
+	{"bat", "batch", "cmd"},
+	{"c"},
+	{"clojure", "clj"},
+	{"coffeescript", "coffee"},
+	{"cpp", "c++", "cxx"},
+	{"csharp", "c#"},
+	{"css"},
+	{"dockerfile", "docker"},
+	{"elixir"},
+	{"erlang", "erl"},
+	{"fsharp", "f#"},
+	{"go", "golang"},
+	{"haskell", "hs"},
+	{"html", "htm", "xhtml"},
+	{"ini"},
+	{"java"},
+	{"javascript", "js", "node"},
+	{"javascriptreact", "jsx"},
+	{"json"},
+	{"kotlin", "kt"},
+	{"latex", "tex"},
+	{"lua"},
+	{"makefile", "make"},
+	{"markdown", "md"},
+	{"objective-c", "objc"},
+	{"ocaml"},
+	{"perl"},
+	{"php"},
+	{"plaintext", "text", "txt"},
+	{"powershell", "ps1", "pwsh"},
+	{"python", "py", "python3"},
+	{"r"},
+	{"ruby", "rb"},
+	{"rust", "rs"},
+	{"scala"},
+	{"shellscript", "shell", "sh", "bash", "zsh"},
+	{"sql"},
+	{"swift"},
+	{"toml"},
+	{"typescript", "ts"},
+	{"typescriptreact", "tsx"},
+	{"xml"},
+	{"yaml", "yml"},
+}
+
+// aliasGroup returns the well-known names of the language id, or nil.
+func aliasGroup(id string) []string {
+	id = strings.ToLower(id)
+	for _, group := range languageAliases {
+		if slices.Contains(group, id) {
+			return group
+		}
+	}
+	return nil
+}
+
+// scopeLanguage derives a language identifier from a scope: the last component, or a well-known
+// language among the others, so that `text.html.basic` is `html`.
+func scopeLanguage(scope string) string {
+	parts := strings.Split(scope, ".")
+	for i := len(parts) - 1; i > 0; i-- {
+		if group := aliasGroup(parts[i]); group != nil {
+			return group[0]
+		}
+	}
+	return parts[len(parts)-1]
+}
+
+// buildLanguages derives the languages from manifests and grammars and indexes them by every
+// key, l.mu must be held. Keys of languages with a grammar of higher priority take precedence,
+// identifiers over names and aliases over extensions, file names and mime types.
+func (l *Loader) buildLanguages() {
+	langs := make(map[string]*Language)
+	var order []*Language
+	language := func(id string) *Language {
+		lang, ok := langs[id]
+		if !ok {
+			lang = &Language{ID: id}
+			langs[id] = lang
+			order = append(order, lang)
+		}
+		return lang
+	}
+
+	/* a language declared for several grammars uses the one of the highest priority, like FromFileName */
+	scopes := make(map[string]string)
+	declared := make(map[string]bool)
+	for scope, contrib := range l.contributions {
+		grm := l.winner(scope)
+		if contrib.Language == "" || grm == nil {
+			continue
+		}
+		declared[scope] = true
+		if prev, ok := scopes[contrib.Language]; !ok || comparePriority(grm, l.winner(prev)) < 0 {
+			scopes[contrib.Language] = scope
+		}
+	}
+	for _, contrib := range l.languages {
+		lang := language(contrib.ID)
+		if lang.Name == "" && len(contrib.Aliases) > 0 {
+			lang.Name = contrib.Aliases[0]
+		}
+		lang.Aliases = append(lang.Aliases, contrib.Aliases...)
+		for _, ext := range contrib.Extensions {
+			lang.Extensions = append(lang.Extensions, strings.TrimLeft(ext, "."))
+		}
+		lang.Filenames = append(lang.Filenames, contrib.Filenames...)
+		lang.MimeTypes = append(lang.MimeTypes, contrib.MimeTypes...)
+		lang.Scope = scopes[contrib.ID]
+	}
+
+	/* grammars not declared by a manifest are a language of their own */
+	for _, scope := range slices.Sorted(maps.Keys(l.scopes)) {
+		if declared[scope] {
+			continue
+		}
+		grm := l.winner(scope)
+		lang := language(scopeLanguage(scope))
+		if lang.Scope != "" {
+			/* `source.js` and `source.javascript` are one language */
+			lang = language(scope)
+		}
+		if lang.Name == "" {
+			lang.Name = grm.Name
+		}
+		lang.Scope = scope
+		for _, ft := range grm.FileTypes {
+			lang.Extensions = append(lang.Extensions, strings.TrimLeft(ft, "."))
+		}
+	}
+
+	for _, lang := range order {
+		if lang.Name == "" {
+			lang.Name = lang.ID
+		}
+		for _, alias := range aliasGroup(lang.ID) {
+			if alias != lang.ID && !slices.Contains(lang.Aliases, alias) {
+				lang.Aliases = append(lang.Aliases, alias)
+			}
+		}
+		slices.Sort(lang.Extensions)
+		lang.Extensions = slices.Compact(lang.Extensions)
+	}
+
+	slices.SortStableFunc(order, func(a *Language, b *Language) int {
+		ga, gb := l.winner(a.Scope), l.winner(b.Scope)
+		if ga == nil || gb == nil {
+			/* languages with a grammar first */
+			return cmp.Compare(boolInt(ga == nil), boolInt(gb == nil))
+		}
+		return comparePriority(ga, gb)
+	})
+	l.langs = make([]Language, len(order))
+	l.langkeys = make(map[string]int)
+	index := func(i int, key string) {
+		key = strings.ToLower(key)
+		if _, ok := l.langkeys[key]; !ok && key != "" {
+			l.langkeys[key] = i
+		}
+	}
+	for i, lang := range order {
+		l.langs[i] = *lang
+		index(i, lang.ID)
+	}
+	for i, lang := range order {
+		index(i, lang.Name)
+		for _, alias := range lang.Aliases {
+			index(i, alias)
+		}
+	}
+	for i, lang := range order {
+		for _, key := range slices.Concat(lang.Extensions, lang.Filenames, lang.MimeTypes) {
+			index(i, key)
+		}
+	}
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Language looks up a language by its identifier, name, alias, extension, file name or mime
+// type, ignoring case; a leading dot of an extension is optional.
+func (l *Loader) Language(key string) (Language, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key = strings.ToLower(key)
+	i, ok := l.langkeys[key]
+	if !ok {
+		i, ok = l.langkeys[strings.TrimLeft(key, ".")]
+	}
+	if !ok {
+		return Language{}, false
+	}
+	return l.langs[i], true
+}
+
+// Languages returns every known language, ordered by identifier.
+func (l *Loader) Languages() []Language {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	res := slices.Clone(l.langs)
+	slices.SortFunc(res, func(a Language, b Language) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return res
+}
+
+// FromLanguage returns the grammar of the language found by key, see Language.
+func (l *Loader) FromLanguage(key string) (*Grammar, error) {
+	lang, ok := l.Language(key)
+	if !ok || lang.Scope == "" {
+		return nil, os.ErrNotExist
+	}
+	return l.FromScope(lang.Scope)
+}
@@ -0,0 +1,98 @@
+package textmate
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+// testExtension is an extension declaring a language for the grammar in testGrammar.
+var testExtension = fstest.MapFS{
+	"package.json": {Data: []byte(`{"contributes": {
+		"languages": [{"id": "testlang", "aliases": ["Test Language", "tst"], "extensions": [".test"], "filenames": ["testfile"]}],
+		"grammars": [{"language": "testlang", "scopeName": "source.test", "path": "./test.tmLanguage.json"}]
+	}}`)},
+	"test.tmLanguage.json": {Data: []byte(testGrammar)},
+}
+
+func TestLanguage(t *testing.T) {
+	l, err := NewLoaderFromExtension(testExtension)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, scope := range []string{"source.go", "source.perl", "source.ocaml"} {
+		if err := l.Register([]byte(`{"scopeName": "`+scope+`"}`), FormatJSON); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		key  string
+		want string /* identifier, empty if unknown */
+	}{
+		{"testlang", "testlang"},
+		{"Test Language", "testlang"},
+		{"TST", "testlang"},
+		{".test", "testlang"},
+		{"testfile", "testlang"},
+		{"golang", "go"},
+		{"perl", "perl"},
+		{"pl", ""},
+		{"ml", ""},
+		{"cs", ""},
+	}
+	for _, test := range tests {
+		lang, _ := l.Language(test.key)
+		if lang.ID != test.want {
+			t.Errorf("Language(%q) = %q, want %q", test.key, lang.ID, test.want)
+		}
+	}
+
+	g, err := l.FromFileName("testfile")
+	if err != nil || g.ScopeName() != "source.test" {
+		t.Errorf("FromFileName(testfile) = %v, %v", g, err)
+	}
+
+	l.Unregister("source.test")
+	if lang, ok := l.Language("testlang"); ok {
+		t.Errorf("language %v is kept after its grammar is unregistered", lang)
+	}
+}
+
+func TestLanguageTiers(t *testing.T) {
+	extension := func(scope string) []byte {
+		return zipFiles(t, map[string]string{
+			"extension/package.json": `{"contributes": {
+				"languages": [{"id": "foo", "extensions": [".foo"]}],
+				"grammars": [{"language": "foo", "scopeName": "` + scope + `", "path": "./foo.json"}]
+			}}`,
+			"extension/foo.json": `{"scopeName": "` + scope + `", "patterns": []}`,
+		})
+	}
+	tests := []struct {
+		name  string
+		tiers []Tier /* tiers of source.foo.0, source.foo.1 */
+		want  string
+	}{
+		{"higher tier last", []Tier{TierSystem, TierUser}, "source.foo.1"},
+		{"higher tier first", []Tier{TierUser, TierSystem}, "source.foo.0"},
+		{"same tier", []Tier{TierUser, TierUser}, "source.foo.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			/* the languages were built from a map, whose order varies */
+			for range 20 {
+				l, _ := NewLoader(nil)
+				for i, tier := range test.tiers {
+					scope := "source.foo." + string(rune('0'+i))
+					if err := l.AddFS(fstest.MapFS{"foo.vsix": {Data: extension(scope)}}, false, tier); err != nil {
+						t.Fatal(err)
+					}
+				}
+				lang, ok := l.Language("foo")
+				g, err := l.FromFileName("x.foo")
+				if !ok || lang.Scope != test.want || err != nil || g.ScopeName() != test.want {
+					t.Fatalf("Language(foo) = %v, FromFileName = %v, %v, want %s", lang, g, err, test.want)
+				}
+			}
+		})
+	}
+}
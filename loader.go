@@ -1,137 +1,665 @@
 package textmate
 
 import (
-	"encoding/json"
+	"archive/zip"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"iter"
 	"maps"
 	"os"
 	"path"
-	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 
-	"howett.net/plist"
+	"github.com/friedelschoen/go-textmate/regexp"
 )
 
 type Loader struct {
-	filetypes map[string][]*GrammarJSON
-	scopes    map[string]*GrammarJSON
+	mu        sync.Mutex
+	grammars  []*GrammarJSON
+	filetypes map[string][]string       /* scopes claiming a file type by priority */
+	filenames map[string]bool           /* file types which name whole files, see isFileName */
+	scopes    map[string][]*GrammarJSON /* grammars claiming a scope by priority */
 	cache     map[*GrammarJSON]*Grammar
+	tier      Tier
+	seq       int
+	limits    regexp.Limits
+	mode      CompileMode
+	config    RegexpConfig
+	configs   map[string]RegexpConfig
+	logger    func(Diagnostic)
+	diags     Diagnostics
+	pending   []Diagnostic /* diagnostics to pass to the logger once l.mu is released */
+	gen       int          /* counts changes which drop compiled grammars from the cache */
+
+	contributions map[string]GrammarContribution
+	languages     []LanguageContribution
+	associations  []association
+	globs         []fileGlob
+	langs         []Language
+	langkeys      map[string]int /* index in langs by any lower-case key */
+	disk          *diskCache
+	lazy          bool
+	subscribers   []*func(scopes []string)
+	overlays      []*loaderOverlay
+	archive       *archiveSource /* outermost archive whose grammars are being added */
+	strict        bool
+}
+
+var (
+	ErrMissingScopeName = errors.New("grammar has no `scopeName`")
+	ErrDuplicateScope   = errors.New("duplicate `scopeName`")
+)
+
+// Diagnostic describes a problem with a grammar file found by the loader.
+// Err is a decoding error, ErrMissingScopeName, ErrDuplicateScope or a *KeyError. Files with
+// duplicate scopes in the same tier are still loaded and shadow the previous grammar.
+type Diagnostic struct {
+	Path  string
+	Scope string
+	Err   error
 }
 
-func loadFile(pathname string) (*GrammarJSON, error) {
-	content, err := os.ReadFile(pathname)
+func (diag Diagnostic) Error() string {
+	return fmt.Sprintf("%s: %v", diag.Path, diag.Err)
+}
+
+func (diag Diagnostic) Unwrap() error {
+	return diag.Err
+}
+
+// Diagnostics lists problems found with grammar files, see Loader.Diagnostics.
+type Diagnostics []Diagnostic
+
+func (diags Diagnostics) Error() string {
+	msgs := make([]string, len(diags))
+	for i, diag := range diags {
+		msgs[i] = diag.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (diags Diagnostics) Unwrap() []error {
+	res := make([]error, len(diags))
+	for i, diag := range diags {
+		res[i] = diag
+	}
+	return res
+}
+
+// LoaderOption configures a Loader at construction.
+type LoaderOption func(*Loader)
+
+// WithLimits bounds the matching done by grammars of this loader, see regexp.Limits.
+// The time budget applies per TokenizeSequence call; a pattern exceeding any limit
+// leaves the rest of the text unscoped instead of hanging the tokenizer.
+func WithLimits(limits regexp.Limits) LoaderOption {
+	return func(l *Loader) {
+		l.limits = limits
+	}
+}
+
+// WithLogger calls log for every problem found with grammar files, after the call which found
+// them; no locks are held, so log may use the loader.
+func WithLogger(log func(Diagnostic)) LoaderOption {
+	return func(l *Loader) {
+		l.logger = log
+	}
+}
+
+// WithLazyDecode decodes only the name, scope, file types and first line match of grammar files
+// at construction; the rules are decoded when a grammar is first compiled. Errors in the rules
+// are then reported by FromScope and the like, rather than by the constructor.
+func WithLazyDecode() LoaderOption {
+	return func(l *Loader) {
+		l.lazy = true
+	}
+}
+
+// WithCompileMode sets when the patterns of grammars are compiled, CompileLazy by default.
+// CompileEager and CompileCollect are useful to validate grammars as they are loaded.
+func WithCompileMode(mode CompileMode) LoaderOption {
+	return func(l *Loader) {
+		l.mode = mode
+	}
+}
+
+// WithRegexpConfig sets the syntax and options every grammar is compiled with, for example
+// regexp.SyntaxPerlNG for grammars written against a Perl-like engine.
+func WithRegexpConfig(cfg RegexpConfig) LoaderOption {
+	return func(l *Loader) {
+		l.config = cfg
+	}
+}
+
+// WithScopeRegexpConfig overrides the regexp configuration for the grammar named scope.
+func WithScopeRegexpConfig(scope string, cfg RegexpConfig) LoaderOption {
+	return func(l *Loader) {
+		if l.configs == nil {
+			l.configs = make(map[string]RegexpConfig)
+		}
+		l.configs[scope] = cfg
+	}
+}
+
+// loadFile decodes the grammar named name in fsys, pathname is the name used in messages.
+func loadFile(fsys fs.FS, name string, pathname string) (*GrammarJSON, error) {
+	content, err := fs.ReadFile(fsys, name)
 	if err != nil {
 		return nil, err
 	}
-	var encoded GrammarJSON
-	if strings.HasSuffix(pathname, ".json") {
-		err = json.Unmarshal(content, &encoded)
+	var encoded *GrammarJSON
+	if hasExt(name, sublimeExts) {
+		syntax, err := DecodeSublimeSyntax(content)
+		if err != nil {
+			return nil, err
+		}
+		encoded = syntax.GrammarJSON()
 	} else {
-		_, err = plist.Unmarshal(content, &encoded)
+		encoded, err = DecodeGrammar(content, DetectFormat(name, content))
 	}
-	encoded.Name = fmt.Sprintf("%s (%s)", encoded.Name, path.Base(pathname))
-	return &encoded, err
+	encoded.filename = pathname
+	return encoded, err
 }
 
-func NewLoader(paths iter.Seq[string]) (*Loader, bool) {
-	loader := Loader{
-		scopes:    make(map[string]*GrammarJSON),
-		filetypes: make(map[string][]*GrammarJSON),
-		cache:     make(map[*GrammarJSON]*Grammar),
+// loadHeader decodes only the metadata of the grammar named name in fsys, the rules are decoded
+// from the file when the grammar is compiled.
+func loadHeader(fsys fs.FS, name string, pathname string) (*GrammarJSON, error) {
+	content, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := decodeHeader(content, DetectFormat(name, content), hasExt(name, sublimeExts))
+	if err != nil {
+		return nil, err
+	}
+	encoded.filename = pathname
+	encoded.body = func() (*GrammarJSON, error) {
+		return loadFile(fsys, name, pathname)
 	}
+	return encoded, nil
+}
 
-	for pathname := range paths {
-		grm, err := loadFile(pathname)
-		if err != nil {
-			// fmt.Fprintf(os.Stderr, "unable to load %s: %v\n", pathname, err)
-			/* logging? */
-			continue
+// osFS reads files by their operating system path, unlike os.DirFS it accepts
+// absolute and relative paths.
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (osFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+// NewLoader loads the grammars at paths and reports whether any grammar was loaded. Files which
+// could not be loaded are skipped, see Diagnostics and WithLogger. If paths is nil, the loader is
+// empty and grammars are added using Register.
+func NewLoader(paths iter.Seq[string], opts ...LoaderOption) (*Loader, bool) {
+	loader, _ := newLoader(opts, func(l *Loader) error {
+		if paths == nil {
+			return nil
+		}
+		for pathname := range paths {
+			l.addFile(osFS{}, pathname, pathname)
 		}
-		loader.scopes[grm.ScopeName] = grm
-		for _, ft := range grm.FileTypes {
-			ft = strings.TrimLeft(ft, ".")
-			//lint:ignore S1005 unnecessary assignment to `_` -- without the assignment a failed look-up results in a panic where I just want an empty array
-			fts, _ := loader.filetypes[ft]
-			loader.filetypes[ft] = append(fts, grm)
+		return nil
+	})
+	return loader, len(loader.scopes) > 0
+}
+
+// NewLoaderFromFS loads the grammars in the root of fsys, or in the whole tree if walk is set.
+// This allows grammars to be loaded from embedded files, archives or in-memory filesystems.
+// The error is only set if the root of fsys cannot be read, files which could not be loaded
+// are skipped, see Diagnostics and WithLogger.
+func NewLoaderFromFS(fsys fs.FS, walk bool, opts ...LoaderOption) (*Loader, error) {
+	return newLoader(opts, func(l *Loader) error {
+		return l.addFS(fsys, "", walk, nil)
+	})
+}
+
+// NewLoaderFromDir loads the grammars in dir and reports whether any grammar was loaded,
+// see NewLoaderFromFS.
+func NewLoaderFromDir(dir string, walk bool, opts ...LoaderOption) (*Loader, bool) {
+	loader, _ := newLoader(opts, func(l *Loader) error {
+		return l.addFS(newDirFS(dir), dir, walk, nil)
+	})
+	return loader, len(loader.scopes) > 0
+}
+
+// NewLoaderFromArchive loads the grammars inside a zip-based package such as a Sublime Text
+// `.sublime-package` or a VS Code `.vsix`. Only files named like grammars are considered:
+// `.tmLanguage`, `.tmLanguage.json`, `.tmLanguage.yaml`, `.YAML-tmLanguage`, `.plist` and `.sublime-syntax`.
+// The error is only set if r is not a zip archive, see NewLoaderFromFS.
+//
+// Archives found by the other constructors are loaded the same way.
+func NewLoaderFromArchive(r io.ReaderAt, size int64, opts ...LoaderOption) (*Loader, error) {
+	return newLoader(opts, func(l *Loader) error {
+		archive, err := zip.NewReader(r, size)
+		if err != nil {
+			return err
 		}
+		return l.addFS(archive, "", true, isGrammarFile)
+	})
+}
+
+// newLoader constructs a loader which is filled by add, which returns fatal errors only.
+func newLoader(opts []LoaderOption, add func(*Loader) error) (*Loader, error) {
+	loader := Loader{
+		scopes:    make(map[string][]*GrammarJSON),
+		filetypes: make(map[string][]string),
+		cache:     make(map[*GrammarJSON]*Grammar),
 	}
-	return &loader, len(loader.scopes) > 0
+	for _, opt := range opts {
+		opt(&loader)
+	}
+	err := add(&loader)
+	loader.reindex()
+	loader.saveCache()
+	pending := loader.pending
+	loader.pending = nil
+	loader.log(pending...)
+	return &loader, err
+}
+
+// AddDir loads the grammars in dir into tier, overriding grammars of lower tiers. The error is
+// only set if dir cannot be read, files which could not be loaded are skipped, see Diagnostics.
+func (l *Loader) AddDir(dir string, walk bool, tier Tier) error {
+	return l.addTier(tier, func() error {
+		return l.addFS(newDirFS(dir), dir, walk, nil)
+	})
+}
+
+// AddFS loads the grammars in fsys into tier, see AddDir and NewLoaderFromFS.
+func (l *Loader) AddFS(fsys fs.FS, walk bool, tier Tier) error {
+	return l.addTier(tier, func() error {
+		return l.addFS(fsys, "", walk, nil)
+	})
+}
+
+// addTier calls add with grammars being loaded into tier.
+func (l *Loader) addTier(tier Tier, add func() error) error {
+	l.mu.Lock()
+	defer l.unlock()
+	prev := l.tier
+	l.tier = tier
+	err := add()
+	l.tier = prev
+	l.reindex()
+	l.saveCache()
+	return err
 }
 
-func NewLoaderFromDir(dir string, walk bool) (*Loader, bool) {
+// addFS loads every file in the root of fsys, or in the whole tree if walk is set. Files are
+// reported relative to prefix and skipped if match is set and returns false. The error is only
+// set if the root cannot be read.
+func (l *Loader) addFS(fsys fs.FS, prefix string, walk bool, match func(string) bool) error {
 	if walk {
-		return NewLoader(func(yield func(string) bool) {
-			filepath.WalkDir(dir, func(pathname string, d fs.DirEntry, err error) error {
-				if !d.IsDir() {
-					if !yield(path.Join(dir, pathname)) {
-						return filepath.SkipAll
-					}
-				}
-				return nil
-			})
-		})
-	} else {
-		return NewLoader(func(yield func(string) bool) {
-			entries, err := os.ReadDir(dir)
+		return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+			if err != nil && name == "." {
+				return err
+			}
 			if err != nil {
-				return
+				l.diagnose(Diagnostic{Path: path.Join(prefix, name), Err: err})
+				return nil
 			}
-			for _, entry := range entries {
-				if !entry.IsDir() {
-					if !yield(path.Join(dir, entry.Name())) {
-						return
-					}
-				}
+			if !d.IsDir() && (match == nil || match(name)) {
+				l.addFile(fsys, name, path.Join(prefix, name))
 			}
+			return nil
 		})
 	}
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && (match == nil || match(entry.Name())) {
+			l.addFile(fsys, entry.Name(), path.Join(prefix, entry.Name()))
+		}
+	}
+	return nil
+}
+
+var (
+	// archiveExts are the zip-based package formats grammars are distributed in.
+	archiveExts = []string{".sublime-package", ".vsix", ".zip"}
+	// grammarExts name grammar files within archives, which mostly contain other files.
+	grammarExts = []string{".tmlanguage", ".tmlanguage.json", ".tmlanguage.yaml", ".tmlanguage.yml", ".yaml-tmlanguage", ".plist", ".sublime-syntax"}
+	// plistExts name property lists, which only hold a grammar if they have a scope.
+	plistExts = []string{".plist"}
+	// sublimeExts name Sublime Text syntaxes, which are decoded by DecodeSublimeSyntax.
+	sublimeExts = []string{".sublime-syntax"}
+)
+
+// hasExt reports whether name ends in one of exts, ignoring case.
+func hasExt(name string, exts []string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range exts {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func isGrammarFile(name string) bool {
+	return hasExt(name, grammarExts)
+}
+
+// addArchive loads the grammars in the zip archive named name in fsys.
+func (l *Loader) addArchive(fsys fs.FS, name string, pathname string) {
+	archive, src, err := openArchive(fsys, name)
+	if err != nil {
+		l.diagnose(Diagnostic{Path: pathname, Err: err})
+		return
+	}
+	src.pathname = pathname
+	l.addArchiveFS(archive, src)
+}
+
+// addArchiveFS loads the grammars in archive, which was read from src.
+func (l *Loader) addArchiveFS(archive *zip.Reader, src *archiveSource) {
+	if l.archive == nil {
+		src.tier = l.tier
+		l.archive = src
+		defer func() {
+			l.archive = nil
+		}()
+	}
+	if ext, err := fs.Sub(archive, "extension"); err == nil && l.addExtension(ext, path.Join(src.pathname, "extension")) {
+		return
+	}
+	if err := l.addFS(archive, src.pathname, true, isGrammarFile); err != nil {
+		l.diagnose(Diagnostic{Path: src.pathname, Err: err})
+	}
+}
+
+// openArchive reads the zip archive named name in fsys, src describes the file as it was read.
+func openArchive(fsys fs.FS, name string) (archive *zip.Reader, src *archiveSource, err error) {
+	info, err := fs.Stat(fsys, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	archive, err = zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil, nil, err
+	}
+	return archive, &archiveSource{fileSource: fileSource{fsys: fsys, name: name, size: info.Size(), modTime: info.ModTime()}}, nil
+}
+
+// addFile loads the grammar named name in fsys, problems are reported as diagnostics.
+// Archives are searched for grammars instead.
+func (l *Loader) addFile(fsys fs.FS, name string, pathname string) {
+	if hasExt(name, archiveExts) {
+		l.addArchive(fsys, name, pathname)
+		return
+	}
+	grm, err := l.loadFile(fsys, name, pathname)
+	if err != nil {
+		l.diagnose(Diagnostic{Path: pathname, Err: err})
+		return
+	}
+	l.add(grm, pathname)
+}
+
+// add registers a decoded grammar, pathname is the name used in messages. Plain property lists
+// without a scope, such as the `Info.plist` of a bundle, are not grammars and skipped quietly.
+func (l *Loader) add(grm *GrammarJSON, pathname string) {
+	if grm.ScopeName == "" && hasExt(pathname, plistExts) {
+		return
+	}
+	if grm.ScopeName == "" {
+		l.diagnose(Diagnostic{Path: pathname, Err: ErrMissingScopeName})
+		return
+	}
+	for _, prev := range slices.Backward(l.grammars) {
+		if prev.ScopeName == grm.ScopeName && prev.tier == l.tier {
+			l.diagnose(Diagnostic{Path: pathname, Scope: grm.ScopeName, Err: fmt.Errorf("%w, shadowing %s", ErrDuplicateScope, describe(prev))})
+			break
+		}
+	}
+	l.insert(grm)
+}
+
+// insert adds grm to the current tier, the indices are updated by reindex.
+func (l *Loader) insert(grm *GrammarJSON) {
+	grm.tier = l.tier
+	grm.seq = l.seq
+	l.seq++
+	l.grammars = append(l.grammars, grm)
+}
+
+// diagnose records diag, which is passed to the logger by unlock.
+func (l *Loader) diagnose(diag Diagnostic) {
+	l.diags = append(l.diags, diag)
+	l.pending = append(l.pending, diag)
+}
+
+// unlock releases l.mu and passes the diagnostics found meanwhile to the logger.
+func (l *Loader) unlock() {
+	pending := l.pending
+	l.pending = nil
+	l.mu.Unlock()
+	l.log(pending...)
+}
+
+// log passes diags to the logger, l.mu must not be held.
+func (l *Loader) log(diags ...Diagnostic) {
+	if l.logger == nil {
+		return
+	}
+	for _, diag := range diags {
+		l.logger(diag)
+	}
+}
+
+// Diagnostics returns every problem found with grammar files so far, in the order found.
+func (l *Loader) Diagnostics() Diagnostics {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.diags)
+}
+
+// Register decodes a grammar written in format and registers it, see RegisterGrammar. With
+// WithStrictDecode, its ignored keys are reported as diagnostics.
+func (l *Loader) Register(content []byte, format Format) error {
+	grm, err := DecodeGrammar(content, format)
+	if err != nil {
+		return err
+	}
+	if err := l.RegisterGrammar(grm); err != nil {
+		return err
+	}
+	if l.strict {
+		errs, _ := CheckGrammarKeys(content, format)
+		l.mu.Lock()
+		defer l.unlock()
+		for _, err := range errs {
+			l.diagnose(Diagnostic{Path: grm.ScopeName, Scope: grm.ScopeName, Err: err})
+		}
+	}
+	return nil
+}
+
+// RegisterGrammar adds a grammar, replacing every grammar with the same scope in any tier; it is
+// registered in the tier given by WithTier. Grammars which include the scope use the new grammar
+// from now on, grammars obtained before keep their rules.
+// A Sublime syntax is registered by its SublimeSyntax.GrammarJSON. The loader keeps a shallow
+// copy of grm, its rules are shared and must not be changed afterwards.
+func (l *Loader) RegisterGrammar(grm *GrammarJSON) error {
+	if grm.ScopeName == "" {
+		return ErrMissingScopeName
+	}
+	copied := *grm
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.remove(copied.ScopeName)
+	l.insert(&copied)
+	l.reindex()
+	return nil
+}
+
+// hasScope reports whether a grammar named scope is registered.
+func (l *Loader) hasScope(scope string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.scopes[scope]
+	return ok
+}
+
+// Unregister removes every grammar named scope in any tier and reports whether there was one.
+func (l *Loader) Unregister(scope string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.remove(scope) {
+		return false
+	}
+	l.reindex()
+	return true
 }
 
+// remove drops every grammar named scope and their compiled grammars, the indices are
+// updated by reindex.
+func (l *Loader) remove(scope string) bool {
+	if _, ok := l.scopes[scope]; !ok {
+		return false
+	}
+	named := func(grm *GrammarJSON) bool {
+		return grm.ScopeName == scope
+	}
+	l.grammars = slices.DeleteFunc(l.grammars, named)
+	l.dropContribution(scope)
+	l.globs = slices.DeleteFunc(l.globs, func(glob fileGlob) bool {
+		return glob.scope == scope
+	})
+	maps.DeleteFunc(l.cache, func(grm *GrammarJSON, _ *Grammar) bool {
+		return named(grm)
+	})
+	l.gen++
+	return true
+}
+
+// load compiles grm with its overlays applied or returns it from the cache, l.mu must be held.
+// It is released while compiling, so other grammars can be obtained meanwhile.
 func (l *Loader) load(grm *GrammarJSON) (*Grammar, error) {
 	if comp, ok := l.cache[grm]; ok {
 		return comp, nil
 	}
-	comp, err := CompileGrammar(l, grm)
-	l.cache[grm] = comp
-	return comp, err
+	overlays := l.overlaysFor(grm.ScopeName)
+	gen := l.gen
+	l.mu.Unlock()
+	comp, err := compileOverlaid(l, grm, overlays)
+	l.mu.Lock()
+	if err != nil {
+		return nil, err
+	}
+	if cached, ok := l.cache[grm]; ok {
+		/* compiled by another call meanwhile */
+		comp.free()
+		return cached, nil
+	}
+	if l.gen == gen {
+		l.cache[grm] = comp
+	}
+	return comp, nil
+}
+
+// regexpConfig returns the configuration for patterns of the grammar named scope.
+func (l *Loader) regexpConfig(scope string) RegexpConfig {
+	if cfg, ok := l.configs[scope]; ok {
+		return cfg
+	}
+	return l.config
+}
+
+// Contribution returns how the grammar named scope was declared in an extension manifest,
+// ok is false if it was not loaded from an extension.
+func (l *Loader) Contribution(scope string) (contrib GrammarContribution, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	contrib, ok = l.contributions[scope]
+	return
+}
+
+// Close frees every grammar compiled by this loader. Grammars obtained from it must not be
+// used afterwards, but the loader itself may be used to compile them again.
+func (l *Loader) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for grm, comp := range l.cache {
+		comp.free()
+		delete(l.cache, grm)
+	}
+}
+
+// uncache drops comp from the cache, after it was closed.
+func (l *Loader) uncache(comp *Grammar) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	maps.DeleteFunc(l.cache, func(_ *GrammarJSON, cached *Grammar) bool {
+		return cached == comp
+	})
 }
 
 func (l *Loader) FromScope(scope string) (*Grammar, error) {
-	grm, ok := l.scopes[scope]
-	if !ok {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	grm := l.winner(scope)
+	if grm == nil {
 		return nil, os.ErrNotExist
 	}
 	return l.load(grm)
 }
 
+// FromFileType returns a grammar for ft, index 0 being the grammar of the highest priority;
+// see Tier for the order and ExplainFileType for the grammars at each index.
 func (l *Loader) FromFileType(ft string, index int) (*Grammar, error) {
-	grms, ok := l.filetypes[ft]
-	if !ok || index >= len(grms) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	scopes, ok := l.filetypes[ft]
+	if !ok || index < 0 || index >= len(scopes) {
 		return nil, os.ErrNotExist
 	}
-	return l.load(grms[index])
+	return l.load(l.winner(scopes[index]))
 }
 
+// Scopes iterates the scopes of the registered grammars, as of the call.
 func (l *Loader) Scopes() iter.Seq[string] {
-	return maps.Keys(l.scopes)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Values(slices.Collect(maps.Keys(l.scopes)))
 }
 
+// FileTypes iterates the file types of the registered grammars, as of the call.
 func (l *Loader) FileTypes() iter.Seq[string] {
-	return maps.Keys(l.filetypes)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Values(slices.Collect(maps.Keys(l.filetypes)))
 }
 
+// FileTypeNames iterates the file types with the names of the grammars for them, as of the call.
 func (l *Loader) FileTypeNames() iter.Seq2[string, []string] {
-	return func(yield func(string, []string) bool) {
-		for ft, grms := range l.filetypes {
-			var names []string
-			for _, grm := range grms {
-				names = append(names, grm.Name)
-			}
-			if !yield(ft, names) {
-				return
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	names := make(map[string][]string, len(l.filetypes))
+	for ft, scopes := range l.filetypes {
+		for _, scope := range scopes {
+			grm := l.winner(scope)
+			name := grm.Name
+			if grm.filename != "" {
+				name = fmt.Sprintf("%s (%s)", grm.Name, path.Base(grm.filename))
 			}
+			names[ft] = append(names[ft], name)
 		}
 	}
+	return maps.All(names)
 }
@@ -0,0 +1,310 @@
+package textmate
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/friedelschoen/go-textmate/regexp"
+)
+
+const testGrammar = `{"scopeName": "source.test", "fileTypes": ["test"], "patterns": [{"match": "\\bif\\b", "name": "keyword"}]}`
+
+func TestCloseCachedGrammar(t *testing.T) {
+	l, _ := NewLoader(nil)
+	if err := l.Register([]byte(testGrammar), FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	g, err := l.FromScope("source.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := scopes(t, g, "if"); len(got) != 1 {
+		t.Fatalf("got %q, want a keyword", got)
+	}
+	g.Close()
+
+	again, err := l.FromScope("source.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == g {
+		t.Fatal("closed grammar is still cached")
+	}
+	if got := scopes(t, again, "if"); len(got) != 1 {
+		t.Errorf("got %q, want a keyword", got)
+	}
+	l.Close()
+}
+
+func TestLoaderDiagnostics(t *testing.T) {
+	fsys := fstest.MapFS{
+		"test.tmLanguage.json": {Data: []byte(testGrammar)},
+		"broken.json":          {Data: []byte(`{"scopeName": `)},
+		"noscope.json":         {Data: []byte(`{"patterns": []}`)},
+	}
+	var logged []Diagnostic
+	l, err := NewLoaderFromFS(fsys, false, WithLogger(func(diag Diagnostic) {
+		logged = append(logged, diag)
+	}))
+	if err != nil {
+		t.Fatalf("NewLoaderFromFS: %v", err)
+	}
+	if _, err := l.FromScope("source.test"); err != nil {
+		t.Errorf("FromScope: %v", err)
+	}
+	diags := l.Diagnostics()
+	if len(diags) != 2 || len(logged) != 2 {
+		t.Fatalf("got diagnostics %v, logged %v, want 2", diags, logged)
+	}
+	if !errors.Is(diags, ErrMissingScopeName) {
+		t.Errorf("got %v, want ErrMissingScopeName", diags)
+	}
+
+	if _, err := NewLoaderFromFS(fstest.MapFS{}, false); err != nil {
+		t.Errorf("empty fs: %v", err)
+	}
+	if _, err := NewLoaderFromFS(os.DirFS("does-not-exist"), false); err == nil {
+		t.Error("missing root: no error")
+	}
+	if _, ok := NewLoader(nil); ok {
+		t.Error("empty loader reports grammars")
+	}
+}
+
+func TestArchiveSkipsPlists(t *testing.T) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	files := map[string]string{
+		"Info.plist": `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0"><dict><key>CFBundleName</key><string>Test</string></dict></plist>`,
+		"Syntaxes/Test.plist": `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0"><dict><key>scopeName</key><string>source.test</string><key>patterns</key><array/></dict></plist>`,
+		"Syntaxes/Broken.tmLanguage": `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0"><dict><key>patterns</key><array/></dict></plist>`,
+	}
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := NewLoaderFromArchive(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.hasScope("source.test") {
+		t.Error("grammar in plist not loaded")
+	}
+	diags := l.Diagnostics()
+	if len(diags) != 1 || diags[0].Path != "Syntaxes/Broken.tmLanguage" {
+		t.Errorf("got %v, want only Broken.tmLanguage", diags)
+	}
+}
+
+func TestLoggerMayUseLoader(t *testing.T) {
+	fsys := fstest.MapFS{
+		"test.tmLanguage.json": {Data: []byte(testGrammar)},
+		"broken.json":          {Data: []byte(`{"scopeName": `)},
+	}
+	var l *Loader
+	var logged int
+	l, _ = NewLoader(nil, WithLogger(func(diag Diagnostic) {
+		logged += len(l.Diagnostics())
+		l.FromScope("source.test")
+	}))
+	done := make(chan error)
+	go func() {
+		done <- l.AddFS(fsys, false, TierUser)
+	}()
+	select {
+	case err := <-done:
+		if err != nil || logged != 1 {
+			t.Errorf("AddFS = %v, logged %d diagnostics, want 1", err, logged)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("logger deadlocks")
+	}
+}
+
+func TestConcurrentLoad(t *testing.T) {
+	l, _ := NewLoader(nil)
+	if err := l.Register([]byte(testGrammar), FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	grammars := make([]*Grammar, 8)
+	for i := range grammars {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			grammars[i], _ = l.FromScope("source.test")
+		}()
+	}
+	wg.Wait()
+	for _, g := range grammars {
+		if g != grammars[0] {
+			t.Fatal("concurrent loads return different grammars")
+		}
+	}
+}
+
+func TestConcurrentCompileAndRegister(t *testing.T) {
+	fsys := fstest.MapFS{
+		"A.sublime-syntax": {Data: []byte("scope: source.a\ncontexts:\n  main:\n    - include: Packages/B/B.sublime-syntax\n")},
+		"B.sublime-syntax": {Data: []byte("scope: source.b\ncontexts:\n  main:\n    - match: b\n      scope: b\n")},
+	}
+	l, err := NewLoaderFromFS(fsys, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for range 200 {
+			g, err := l.FromScope("source.a")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			/* closing the grammar drops it from the cache, so it is compiled again */
+			g.Close()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range 200 {
+			if err := l.Register([]byte(testGrammar), FormatJSON); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+// countFS counts the files read from it.
+type countFS struct {
+	fstest.MapFS
+	reads map[string]int
+}
+
+func (fsys countFS) ReadFile(name string) ([]byte, error) {
+	fsys.reads[name]++
+	return fsys.MapFS.ReadFile(name)
+}
+
+func TestLazyDecode(t *testing.T) {
+	fsys := countFS{fstest.MapFS{
+		"test.json": {Data: []byte(testGrammar)},
+		/* the header decodes, the rules do not */
+		"broken.json": {Data: []byte(`{"scopeName": "source.broken", "patterns": {"match": "x"}}`)},
+		"strict.json": {Data: []byte(`{"scopeName": "source.strict", "patterns": [{"match": "a", "contentName": "c"}]}`)},
+	}, make(map[string]int)}
+	tests := []struct {
+		name     string
+		opts     []LoaderOption
+		loaded   int /* reads of test.json by the constructor */
+		compiled int /* reads of test.json after compiling it */
+		keys     int /* *KeyError diagnostics of strict.json */
+	}{
+		{"eager", nil, 1, 1, 0},
+		{"lazy", []LoaderOption{WithLazyDecode()}, 1, 2, 0},
+		/* the keys are checked when the file is loaded */
+		{"lazy and strict", []LoaderOption{WithLazyDecode(), WithStrictDecode()}, 2, 3, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clear(fsys.reads)
+			l, err := NewLoaderFromFS(fsys, false, test.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fsys.reads["test.json"]; got != test.loaded {
+				t.Errorf("test.json read %d times when loaded, want %d", got, test.loaded)
+			}
+			lazy := test.compiled > test.loaded
+			var decodeErrs, keys int
+			for _, diag := range l.Diagnostics() {
+				if errors.As(diag, new(*KeyError)) {
+					if diag.Path == "strict.json" {
+						keys++
+					}
+				} else if diag.Path == "broken.json" {
+					decodeErrs++
+				}
+			}
+			if keys != test.keys || (decodeErrs > 0) == lazy {
+				t.Errorf("got %d key and %d decode diagnostics", keys, decodeErrs)
+			}
+
+			for range 2 {
+				if _, err := l.FromScope("source.test"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := fsys.reads["test.json"]; got != test.compiled {
+				t.Errorf("test.json read %d times when compiled twice, want %d", got, test.compiled)
+			}
+
+			/* broken rules are reported by FromScope if decoded lazily */
+			_, err = l.FromScope("source.broken")
+			if lazy && (err == nil || errors.Is(err, os.ErrNotExist)) {
+				t.Errorf("broken grammar: got %v, want a decode error", err)
+			} else if !lazy && !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("broken grammar: got %v, want os.ErrNotExist", err)
+			}
+		})
+	}
+}
+
+func TestScopeRegexpConfig(t *testing.T) {
+	l, _ := NewLoader(nil,
+		WithCompileMode(CompileEager),
+		WithRegexpConfig(RegexpConfig{Syntax: regexp.SyntaxPerl}),
+		WithScopeRegexpConfig("source.ng", RegexpConfig{Syntax: regexp.SyntaxPerlNG}),
+		WithScopeRegexpConfig("source.python", RegexpConfig{Syntax: regexp.SyntaxPython}),
+	)
+	tests := []struct {
+		scope   string
+		pattern string
+		ok      bool
+	}{
+		/* named groups are not Perl syntax */
+		{"source.perl", `(?<w>if)`, false},
+		{"source.ng", `(?<w>if)`, true},
+		{"source.python", `(?P<w>if)`, true},
+		{"source.ng", `(?P<w>if)`, false},
+	}
+	for _, test := range tests {
+		grammar := `{"scopeName": "` + test.scope + `", "patterns": [{"match": "` + test.pattern + `", "name": "keyword"}]}`
+		if err := l.Register([]byte(grammar), FormatJSON); err != nil {
+			t.Fatal(err)
+		}
+		g, err := l.FromScope(test.scope)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: %s compiled", test.scope, test.pattern)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.scope, err)
+		}
+		if got := scopes(t, g, "if"); !slices.Equal(got, []string{"keyword:if"}) {
+			t.Errorf("%s: got %q, want if as a keyword", test.scope, got)
+		}
+	}
+}
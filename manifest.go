@@ -0,0 +1,158 @@
+package textmate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// ExtensionManifest is the part of a VS Code extension's `package.json` which declares
+// languages and grammars.
+type ExtensionManifest struct {
+	Name        string `json:"name"`
+	Publisher   string `json:"publisher"`
+	Contributes struct {
+		Languages []LanguageContribution `json:"languages"`
+		Grammars  []GrammarContribution  `json:"grammars"`
+	} `json:"contributes"`
+}
+
+// LanguageContribution is an entry of `contributes.languages`.
+type LanguageContribution struct {
+	ID               string   `json:"id"`
+	Aliases          []string `json:"aliases"`
+	Extensions       []string `json:"extensions"`
+	Filenames        []string `json:"filenames"`
+	FilenamePatterns []string `json:"filenamePatterns"`
+	FirstLine        string   `json:"firstLine"`
+	MimeTypes        []string `json:"mimetypes"`
+}
+
+// GrammarContribution is an entry of `contributes.grammars`. Path is relative to the extension.
+type GrammarContribution struct {
+	Language          string            `json:"language"`
+	ScopeName         string            `json:"scopeName"`
+	Path              string            `json:"path"`
+	EmbeddedLanguages map[string]string `json:"embeddedLanguages"`
+	InjectTo          []string          `json:"injectTo"`
+}
+
+// NewLoaderFromExtension loads the grammars declared in the `package.json` in the root of fsys,
+// which is an (unpacked) VS Code extension. The file types of a grammar are taken from the
+// extensions, filenames and filename patterns of its language, in addition to the `fileTypes`
+// in the grammar. The error is only set if there is no `package.json`, problems with the
+// manifest and the grammars are reported by Diagnostics and WithLogger.
+func NewLoaderFromExtension(fsys fs.FS, opts ...LoaderOption) (*Loader, error) {
+	return newLoader(opts, func(l *Loader) error {
+		if !l.addExtension(fsys, "") {
+			return fmt.Errorf("package.json: %w", fs.ErrNotExist)
+		}
+		return nil
+	})
+}
+
+// NewLoaderFromExtensionDir loads the VS Code extension in dir, see NewLoaderFromExtension.
+// If dir has no `package.json`, every subdirectory is loaded as an extension instead, so that
+// a directory like `~/.vscode/extensions` can be loaded at once.
+func NewLoaderFromExtensionDir(dir string, opts ...LoaderOption) (*Loader, error) {
+	return newLoader(opts, func(l *Loader) error {
+		if l.addExtension(newDirFS(dir), dir) {
+			return nil
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				sub := path.Join(dir, entry.Name())
+				l.addExtension(newDirFS(sub), sub)
+			}
+		}
+		return nil
+	})
+}
+
+// addExtension loads the grammars declared in the manifest in the root of fsys and reports
+// whether there was a manifest. Files are reported relative to prefix.
+func (l *Loader) addExtension(fsys fs.FS, prefix string) bool {
+	content, err := fs.ReadFile(fsys, "package.json")
+	if errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	manifestpath := path.Join(prefix, "package.json")
+	if err != nil {
+		l.diagnose(Diagnostic{Path: manifestpath, Err: err})
+		return true
+	}
+	var manifest ExtensionManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		l.diagnose(Diagnostic{Path: manifestpath, Err: err})
+		return true
+	}
+
+	languages := make(map[string]LanguageContribution)
+	for _, lang := range manifest.Contributes.Languages {
+		languages[lang.ID] = lang
+		l.languages = append(l.languages, lang)
+	}
+	for _, contrib := range manifest.Contributes.Grammars {
+		name := path.Clean(strings.TrimPrefix(contrib.Path, "./"))
+		pathname := path.Join(prefix, name)
+		grm, err := l.loadFile(fsys, name, pathname)
+		if err != nil {
+			l.diagnose(Diagnostic{Path: pathname, Scope: contrib.ScopeName, Err: err})
+			continue
+		}
+		grm.source.declared = true
+		if contrib.ScopeName != "" {
+			if grm.ScopeName != "" && grm.ScopeName != contrib.ScopeName {
+				l.diagnose(Diagnostic{Path: pathname, Scope: contrib.ScopeName, Err: fmt.Errorf("%w: declared as `%s` in %s", ErrScopeName, contrib.ScopeName, manifestpath)})
+			}
+			grm.ScopeName = contrib.ScopeName
+		}
+		if lang, ok := languages[contrib.Language]; ok {
+			grm.FileTypes = append(grm.FileTypes, lang.Extensions...)
+			grm.FileTypes = append(grm.FileTypes, lang.Filenames...)
+			if grm.FirstLine == "" {
+				grm.FirstLine = lang.FirstLine
+			}
+			if grm.ScopeName != "" {
+				for _, pattern := range lang.FilenamePatterns {
+					l.globs = append(l.globs, fileGlob{pattern, grm.ScopeName})
+				}
+			}
+		}
+		if grm.ScopeName != "" {
+			if l.contributions == nil {
+				l.contributions = make(map[string]GrammarContribution)
+			}
+			l.contributions[grm.ScopeName] = contrib
+		}
+		l.add(grm, pathname)
+	}
+	return true
+}
+
+// dropContribution forgets how the grammar named scope was declared, and the languages declared
+// for it unless another grammar is declared for them; the languages are rebuilt by reindex.
+func (l *Loader) dropContribution(scope string) {
+	contrib, ok := l.contributions[scope]
+	if !ok {
+		return
+	}
+	delete(l.contributions, scope)
+	for _, other := range l.contributions {
+		if other.Language == contrib.Language {
+			return
+		}
+	}
+	l.languages = slices.DeleteFunc(l.languages, func(lang LanguageContribution) bool {
+		return lang.ID == contrib.Language
+	})
+}
@@ -3,6 +3,7 @@ package textmate
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"slices"
@@ -42,6 +43,16 @@ type StackItem struct {
 	rules    []rule
 	offset   int
 	previous *StackItem
+
+	/* meta scopes of Sublime contexts, emitted when the frame is popped */
+	metaScope     string
+	contentScope  string
+	contentOffset int
+
+	/* Sublime contexts pushed by empty matches at emptyOffset up to this frame, not pushed there again */
+	emptyOffset int
+	emptyPushes []*sublimeContext
+	escape      *sublimeRule /* escape of a Sublime embed, tried before the rules of any frame above */
 }
 
 // Depth returns the nesting depth of this frame (used for token priority).
@@ -60,7 +71,7 @@ type includeRule struct {
 	grammar   *Grammar
 }
 
-func (rule *includeRule) evaluate(offset int, text string, top *StackItem, yield func(*Token), basegrammar *Grammar) (*StackItem, int, error) {
+func (rule *includeRule) evaluate(offset int, text string, top *StackItem, yield func(*Token), basegrammar *Grammar, param *regexp.MatchParam) (*StackItem, int, error) {
 	var othergrammar *Grammar
 	switch rule.scopename {
 	case "", "$self":
@@ -83,7 +94,7 @@ func (rule *includeRule) evaluate(offset int, text string, top *StackItem, yield
 			return nil, 0, fmt.Errorf("unable to include `%s#%s`: unknown rule `%s`", rule.scopename, rule.rulename, rule.rulename)
 		}
 	}
-	return otherrule.evaluate(offset, text, top, yield, basegrammar)
+	return otherrule.evaluate(offset, text, top, yield, basegrammar, param)
 }
 
 type expandRule struct {
@@ -92,11 +103,11 @@ type expandRule struct {
 	grammar *Grammar
 }
 
-func (rule *expandRule) evaluate(offset int, text string, top *StackItem, yield func(*Token), basegrammar *Grammar) (*StackItem, int, error) {
+func (rule *expandRule) evaluate(offset int, text string, top *StackItem, yield func(*Token), basegrammar *Grammar, param *regexp.MatchParam) (*StackItem, int, error) {
 	var consumed int
 	var err error
 	for _, child := range rule.rules {
-		top, consumed, err = child.evaluate(offset, text, top, yield, basegrammar)
+		top, consumed, err = child.evaluate(offset, text, top, yield, basegrammar, param)
 		if err != nil || consumed != 0 {
 			return top, consumed, err
 		}
@@ -106,7 +117,7 @@ func (rule *expandRule) evaluate(offset int, text string, top *StackItem, yield
 
 type matchRule struct {
 	name      string
-	pattern   *regexp.Regexp
+	pattern   *pattern
 	negate    bool /* a succeed pattern means the match failed */
 	captures  []rule
 	rules     []rule
@@ -114,8 +125,12 @@ type matchRule struct {
 	grammar   *Grammar
 }
 
-func (rule *matchRule) evaluate(offset int, text string, top *StackItem, yield func(*Token), basegrammar *Grammar) (*StackItem, int, error) {
-	groups, err := rule.pattern.Match(text, 0, len(text), regexp.OptionNotBeginPosition)
+func (rule *matchRule) evaluate(offset int, text string, top *StackItem, yield func(*Token), basegrammar *Grammar, param *regexp.MatchParam) (*StackItem, int, error) {
+	expr, cerr := rule.pattern.get()
+	if cerr != nil {
+		return top, 0, cerr
+	}
+	groups, err := expr.MatchWithParam(text, 0, len(text), regexp.OptionNotBeginPosition, param)
 	if err != nil || (groups == nil) != rule.negate {
 		return top, 0, err
 	}
@@ -162,7 +177,7 @@ func (rule *matchRule) evaluate(offset int, text string, top *StackItem, yield f
 
 			if othercap.rules != nil {
 				var err error
-				_, err = TokenizeSequence(offset+rng.Start, text[rng.Start:rng.End], &StackItem{rules: othercap.rules, previous: top}, yield, basegrammar)
+				_, err = tokenizeSequence(offset+rng.Start, text[rng.Start:rng.End], &StackItem{rules: othercap.rules, previous: top}, yield, basegrammar, param)
 				if err != nil {
 					return nil, 0, err
 				}
@@ -193,26 +208,38 @@ func (rule *matchRule) evaluate(offset int, text string, top *StackItem, yield f
 // TokenizeSequence tokenizes text[start:end] within the given stack context.
 // Always guarantees progress: if nothing matches, emits a 1-byte filler token (Scope:"").
 func TokenizeSequence(offset int, text string, top *StackItem, yield func(*Token), basegrammar *Grammar) (*StackItem, error) {
+	return tokenizeSequence(offset, text, top, yield, basegrammar, basegrammar.matchParam())
+}
+
+func tokenizeSequence(offset int, text string, top *StackItem, yield func(*Token), basegrammar *Grammar, param *regexp.MatchParam) (*StackItem, error) {
 	lineoffset := 0
 	for lineoffset < len(text) {
-		consumed := false
-		var err error
-		var adv int
+		/* escapes of embeds take priority over the rules of the contexts inside them */
+		next, adv, err := escapeEmbed(offset+lineoffset, text[lineoffset:], top, yield, param)
 		for _, rule := range top.rules {
-			top, adv, err = rule.evaluate(offset+lineoffset, text[lineoffset:], top, yield, basegrammar)
-			if err != nil {
-				return nil, err
-			}
-			if adv > 0 {
-				lineoffset += adv
-			}
-			/* either -1 or positive */
-			if adv != 0 {
-				consumed = true
+			if adv != 0 || err != nil {
 				break
 			}
+			next, adv, err = rule.evaluate(offset+lineoffset, text[lineoffset:], top, yield, basegrammar, param)
+		}
+		if errors.As(err, new(regexp.LimitError)) {
+			/* a runaway pattern leaves the rest unscoped rather than hanging */
+			yield(&Token{
+				Scope:  "",
+				Start:  lineoffset + offset,
+				Length: len(text) - lineoffset,
+			})
+			return top, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		top = next
+		/* either -1 or positive */
+		if adv > 0 {
+			lineoffset += adv
 		}
-		if !consumed {
+		if adv == 0 {
 			yield(&Token{
 				Scope:  "",
 				Start:  lineoffset + offset,
@@ -225,6 +252,14 @@ func TokenizeSequence(offset int, text string, top *StackItem, yield func(*Token
 	return top, nil
 }
 
+// matchParam returns the per-call match limits of the loader, or nil if there are none.
+func (g *Grammar) matchParam() *regexp.MatchParam {
+	if g == nil || g.loader == nil || g.loader.limits == (regexp.Limits{}) {
+		return nil
+	}
+	return regexp.NewMatchParam(g.loader.limits)
+}
+
 // StackItem constructs a root frame for this grammar.
 func (g *Grammar) StackItem() *StackItem {
 	return &StackItem{
@@ -0,0 +1,115 @@
+package textmate
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/friedelschoen/go-textmate/regexp"
+)
+
+// compileTest compiles the grammar written in JSON without a loader.
+func compileTest(t *testing.T, content string) *Grammar {
+	t.Helper()
+	j, err := DecodeGrammar([]byte(content), FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := CompileGrammar(nil, j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(g.Close)
+	return g
+}
+
+// scopes tokenizes text and lists the tokens as `scope:text`, leaving out unscoped tokens.
+func scopes(t *testing.T, g *Grammar, text string) []string {
+	t.Helper()
+	tokens, err := g.TokenizeReader(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res []string
+	for _, tok := range tokens {
+		if tok.Scope != "" {
+			res = append(res, tok.Scope+":"+text[tok.Start:tok.End()])
+		}
+	}
+	return res
+}
+
+func TestTokenizeSequenceWithoutGrammar(t *testing.T) {
+	var tokens []*Token
+	top, err := TokenizeSequence(0, "ab", &StackItem{}, func(tok *Token) {
+		tokens = append(tokens, tok)
+	}, nil)
+	if err != nil || top == nil {
+		t.Fatalf("TokenizeSequence = %v, %v", top, err)
+	}
+	if len(tokens) != 2 {
+		t.Errorf("got %d tokens, want 2 unscoped tokens", len(tokens))
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	g := compileTest(t, `{
+		"scopeName": "source.test",
+		"patterns": [
+			{"match": "\\bif\\b", "name": "keyword"},
+			{"begin": "\"", "end": "\"", "name": "string", "patterns": [{"match": "\\\\.", "name": "escape"}]}
+		]
+	}`)
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"if x", []string{"keyword:if"}},
+		{"iffy", nil},
+		/* the end pattern is scoped by the name of the rule as well */
+		{`"a\n"`, []string{`string:"a\n"`, `escape:\n`, `string:"`}},
+	}
+	for _, test := range tests {
+		got := scopes(t, g, test.text)
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("%q: got %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	l, _ := NewLoader(nil, WithLimits(regexp.Limits{RetryInMatch: 1000}))
+	if err := l.Register([]byte(`{"scopeName": "source.test", "patterns": [
+		{"match": "\\bif\\b", "name": "keyword"},
+		{"match": "(a+)+b", "name": "runaway"}
+	]}`), FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	g, err := l.FromScope("source.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runaway := strings.Repeat("a", 16) + "c"
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"if aab", []string{`keyword:"if"`, `:" "`, `runaway:"aab"`}},
+		/* the rest of the line after the runaway match is one unscoped token */
+		{"if " + runaway + " if\nif", []string{`keyword:"if"`, `:" "`, `:"` + runaway + ` if\n"`, `keyword:"if"`}},
+	}
+	for _, test := range tests {
+		tokens, err := g.TokenizeReader(strings.NewReader(test.text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, tok := range tokens {
+			got = append(got, fmt.Sprintf("%s:%q", tok.Scope, test.text[tok.Start:tok.End()]))
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.text, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package textmate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+	"howett.net/plist"
+)
+
+var (
+	ErrPatchOp      = errors.New("unknown patch operation")
+	ErrPatchTarget  = errors.New("no value at patch path")
+	ErrPatchValue   = errors.New("invalid patch value")
+	ErrNotPatchable = errors.New("grammar is a Sublime syntax and cannot be patched")
+)
+
+// Overlay modifies a grammar before it is compiled, without changing its file. It is written
+// like a grammar, in JSON, plist or YAML:
+//
+//	{
+//		"scopeName": "source.foo",
+//		"patches": [
+//			{"op": "add", "path": "patterns", "value": {"match": "\\bunless\\b", "name": "keyword.control.foo"}},
+//			{"op": "remove", "path": "patterns[2]"},
+//			{"op": "replace", "path": "repository.strings.name", "value": "string.quoted.double.foo"}
+//		]
+//	}
+type Overlay struct {
+	ScopeName string  `json:"scopeName" plist:"scopeName" yaml:"scopeName"`
+	Patches   []Patch `json:"patches" plist:"patches" yaml:"patches"`
+}
+
+// Patch changes the value at Path, which is written like CompileError.Path: keys separated by dots,
+// array indices in brackets and keys containing dots or brackets quoted, as in `repository["a.b"].patterns[0]`.
+//
+//   - `add` inserts Value into an array before the index of Path, appends it to the array named
+//     by Path, or sets a key which does not exist yet;
+//   - `replace` replaces the value at Path with Value;
+//   - `remove` removes the value at Path.
+//
+// Lists such as `patterns` and `fileTypes` must remain arrays: a value added to a list which does
+// not exist yet or replacing a list is an array, other values fail with ErrPatchValue.
+type Patch struct {
+	Op    string `json:"op" plist:"op" yaml:"op"`
+	Path  string `json:"path" plist:"path" yaml:"path"`
+	Value any    `json:"value,omitempty" plist:"value,omitempty" yaml:"value,omitempty"`
+}
+
+// DecodeOverlay decodes an overlay written in format.
+func DecodeOverlay(content []byte, format Format) (*Overlay, error) {
+	var o Overlay
+	var err error
+	switch format {
+	case FormatJSON:
+		err = json.Unmarshal(content, &o)
+	case FormatPlist:
+		_, err = plist.Unmarshal(content, &o)
+	case FormatYAML:
+		err = yaml.Unmarshal(stripYAMLDirective(content), &o)
+	default:
+		err = unknownFormat(format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &o, o.check()
+}
+
+// check validates the operations and paths of the patches.
+func (o *Overlay) check() error {
+	if o.ScopeName == "" {
+		return ErrMissingScopeName
+	}
+	for i, p := range o.Patches {
+		switch p.Op {
+		case "add", "replace", "remove":
+		default:
+			return fmt.Errorf("patches[%d]: %w `%s`", i, ErrPatchOp, p.Op)
+		}
+		if _, err := parsePath(p.Path); err != nil {
+			return fmt.Errorf("patches[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// loaderOverlay is an overlay added to a loader. The overlay of a file is nil while the file
+// cannot be loaded, it is read again by Reload when the file changes.
+type loaderOverlay struct {
+	*Overlay
+	file *fileSource
+}
+
+// WithOverlay applies o to its grammar, see Loader.AddOverlay.
+func WithOverlay(o *Overlay) LoaderOption {
+	return func(l *Loader) {
+		if err := o.check(); err != nil {
+			l.diagnose(Diagnostic{Path: o.ScopeName, Scope: o.ScopeName, Err: err})
+			return
+		}
+		l.overlays = append(l.overlays, &loaderOverlay{Overlay: o})
+	}
+}
+
+// WithOverlayFile applies the overlay in the file at path, problems are reported as diagnostics.
+// The file is read again by Reload when it changes.
+func WithOverlayFile(path string) LoaderOption {
+	return func(l *Loader) {
+		lo := &loaderOverlay{file: &fileSource{fsys: osFS{}, name: path}}
+		l.overlays = append(l.overlays, lo)
+		info, err := os.Stat(path)
+		if err != nil {
+			l.diagnose(Diagnostic{Path: path, Err: err})
+			return
+		}
+		l.loadOverlay(lo, info)
+	}
+}
+
+// loadOverlay reads the file of lo, which is described by info. A file which fails to load keeps
+// the previous overlay.
+func (l *Loader) loadOverlay(lo *loaderOverlay, info fs.FileInfo) {
+	lo.file.size, lo.file.modTime = info.Size(), info.ModTime()
+	content, err := os.ReadFile(lo.file.name)
+	if err != nil {
+		l.diagnose(Diagnostic{Path: lo.file.name, Err: err})
+		return
+	}
+	o, err := DecodeOverlay(content, DetectFormat(lo.file.name, content))
+	if err != nil {
+		l.diagnose(Diagnostic{Path: lo.file.name, Err: err})
+		return
+	}
+	lo.Overlay = o
+}
+
+// AddOverlay applies o to the grammar named o.ScopeName whenever it is compiled, after the
+// overlays added before. Patches apply to the rules: the name, scope and file types by which
+// the grammar is found are not affected. Grammars obtained before keep their rules.
+func (l *Loader) AddOverlay(o *Overlay) error {
+	if err := o.check(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.overlays = append(l.overlays, &loaderOverlay{Overlay: o})
+	for grm := range l.cache {
+		if grm.ScopeName == o.ScopeName {
+			delete(l.cache, grm)
+		}
+	}
+	l.gen++
+	return nil
+}
+
+// overlaysFor returns the overlays for the grammar named scope, l.mu must be held.
+func (l *Loader) overlaysFor(scope string) []*Overlay {
+	var res []*Overlay
+	for _, lo := range l.overlays {
+		if lo.Overlay != nil && lo.ScopeName == scope {
+			res = append(res, lo.Overlay)
+		}
+	}
+	return res
+}
+
+// compileOverlaid compiles grm for l with overlays applied in order.
+func compileOverlaid(l *Loader, grm *GrammarJSON, overlays []*Overlay) (*Grammar, error) {
+	for _, o := range overlays {
+		var err error
+		if grm, err = o.Apply(grm); err != nil {
+			return nil, err
+		}
+	}
+	return CompileGrammar(l, grm)
+}
+
+// Apply returns a copy of j with the patches applied in order, j itself is left as-is. Errors
+// are reported as *CompileError locating the patch. Sublime syntaxes cannot be patched and fail
+// with ErrNotPatchable.
+func (o *Overlay) Apply(j *GrammarJSON) (*GrammarJSON, error) {
+	j, err := j.decoded()
+	if err != nil {
+		return nil, &CompileError{File: j.filename, Scope: j.ScopeName, Err: err}
+	}
+	if j.sublime != nil {
+		return nil, &CompileError{File: j.filename, Scope: j.ScopeName, Err: ErrNotPatchable}
+	}
+	/* patched as generic values, so that any path of the encoded grammar can be addressed */
+	content, err := json.Marshal(j)
+	if err != nil {
+		return nil, err
+	}
+	var tree any
+	if err := json.Unmarshal(content, &tree); err != nil {
+		return nil, err
+	}
+	for _, p := range o.Patches {
+		path, err := parsePath(p.Path)
+		if err == nil {
+			tree, err = patchValue(tree, path, p.Op, jsonValue(p.Value))
+		}
+		if err == nil && p.Op != "remove" && isListPath(path) {
+			if _, ok := valueAt(tree, path).([]any); !ok {
+				err = fmt.Errorf("%w: `%s` is not an array", ErrPatchValue, path[len(path)-1])
+			}
+		}
+		if err != nil {
+			return nil, &CompileError{File: j.filename, Scope: j.ScopeName, Path: p.Path, Err: fmt.Errorf("%s: %w", p.Op, err)}
+		}
+	}
+	if content, err = json.Marshal(tree); err != nil {
+		return nil, err
+	}
+	var res GrammarJSON
+	if err := json.Unmarshal(content, &res); err != nil {
+		return nil, &CompileError{File: j.filename, Scope: j.ScopeName, Err: err}
+	}
+	res.Name = j.Name
+	res.ScopeName = j.ScopeName
+	res.FileTypes = j.FileTypes
+	res.FirstLine = j.FirstLine
+	res.filename = j.filename
+	res.tier = j.tier
+	res.seq = j.seq
+	res.source = j.source
+	return &res, nil
+}
+
+// parsePath splits a path written like CompileError.Path into keys and indices.
+func parsePath(path string) ([]any, error) {
+	var res []any
+	rest := path
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, "[\""):
+			quoted, err := strconv.QuotedPrefix(rest[1:])
+			if err != nil || !strings.HasPrefix(rest[1+len(quoted):], "]") {
+				return nil, fmt.Errorf("invalid path `%s`", path)
+			}
+			key, _ := strconv.Unquote(quoted)
+			res = append(res, key)
+			rest = rest[len(quoted)+2:]
+		case strings.HasPrefix(rest, "["):
+			end := strings.IndexByte(rest, ']')
+			index, err := strconv.Atoi(rest[1:max(end, 1)])
+			if end == -1 || err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid path `%s`", path)
+			}
+			res = append(res, index)
+			rest = rest[end+1:]
+		default:
+			end := strings.IndexAny(rest, ".[")
+			if end == -1 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("invalid path `%s`", path)
+			}
+			res = append(res, rest[:end])
+			rest = rest[end:]
+		}
+		if next, ok := strings.CutPrefix(rest, "."); ok {
+			if next == "" {
+				return nil, fmt.Errorf("invalid path `%s`", path)
+			}
+			rest = next
+		}
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("invalid path `%s`", path)
+	}
+	return res, nil
+}
+
+// patchValue applies op to the value at path in v and returns the changed v.
+func patchValue(v any, path []any, op string, value any) (any, error) {
+	switch v := v.(type) {
+	case map[string]any:
+		key, ok := path[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: expected key, found index %d", ErrPatchTarget, path[0])
+		}
+		child, exists := v[key]
+		if len(path) > 1 {
+			if !exists {
+				return nil, fmt.Errorf("%w: unknown key `%s`", ErrPatchTarget, key)
+			}
+			child, err := patchValue(child, path[1:], op, value)
+			v[key] = child
+			return v, err
+		}
+		switch {
+		case op == "add" && exists:
+			arr, ok := child.([]any)
+			if !ok {
+				return nil, fmt.Errorf("key `%s` exists and is not an array", key)
+			}
+			v[key] = append(arr, value)
+		case op == "add":
+			v[key] = value
+		case !exists:
+			return nil, fmt.Errorf("%w: unknown key `%s`", ErrPatchTarget, key)
+		case op == "replace":
+			v[key] = value
+		case op == "remove":
+			delete(v, key)
+		}
+		return v, nil
+	case []any:
+		index, ok := path[0].(int)
+		if !ok {
+			return nil, fmt.Errorf("%w: expected index, found key `%s`", ErrPatchTarget, path[0])
+		}
+		if index > len(v) || (index == len(v) && (len(path) > 1 || op != "add")) {
+			return nil, fmt.Errorf("%w: index %d out of range", ErrPatchTarget, index)
+		}
+		if len(path) > 1 {
+			child, err := patchValue(v[index], path[1:], op, value)
+			v[index] = child
+			return v, err
+		}
+		switch op {
+		case "add":
+			return slices.Insert(v, index, value), nil
+		case "replace":
+			v[index] = value
+			return v, nil
+		case "remove":
+			return slices.Delete(v, index, index+1), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: `%v` has no children", ErrPatchTarget, path[0])
+}
+
+// isListPath reports whether path names a list of a grammar, such as `patterns` or
+// `repository.a.patterns`, rather than a rule or a value within one.
+func isListPath(path []any) bool {
+	named := false /* the next key names a rule in the repository or captures */
+	for i, elem := range path {
+		key, ok := elem.(string)
+		if !ok || named {
+			named = false
+			continue
+		}
+		if i == len(path)-1 {
+			return key == "patterns" || key == "fileTypes"
+		}
+		switch key {
+		case "repository", "captures", "beginCaptures", "endCaptures":
+			named = true
+		}
+	}
+	return false
+}
+
+// valueAt returns the value at path in v, or nil if there is none.
+func valueAt(v any, path []any) any {
+	for _, elem := range path {
+		switch elem := elem.(type) {
+		case string:
+			m, _ := v.(map[string]any)
+			v = m[elem]
+		case int:
+			arr, _ := v.([]any)
+			if elem >= len(arr) {
+				return nil
+			}
+			v = arr[elem]
+		}
+	}
+	return v
+}
+
+// jsonValue converts maps decoded from YAML, whose keys need not be strings, to JSON values.
+func jsonValue(v any) any {
+	switch v := v.(type) {
+	case map[any]any:
+		res := make(map[string]any, len(v))
+		for key, child := range v {
+			res[fmt.Sprint(key)] = jsonValue(child)
+		}
+		return res
+	case map[string]any:
+		res := make(map[string]any, len(v))
+		for key, child := range v {
+			res[key] = jsonValue(child)
+		}
+		return res
+	case []any:
+		res := make([]any, len(v))
+		for i, child := range v {
+			res[i] = jsonValue(child)
+		}
+		return res
+	}
+	return v
+}
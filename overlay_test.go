@@ -0,0 +1,152 @@
+package textmate
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want []any /* nil if invalid */
+	}{
+		{"patterns", []any{"patterns"}},
+		{"patterns[2].match", []any{"patterns", 2, "match"}},
+		{`repository["a.b"].patterns[0]`, []any{"repository", "a.b", "patterns", 0}},
+		{`repository["x[0]"]`, []any{"repository", "x[0]"}},
+		{"patterns[0][1]", []any{"patterns", 0, 1}},
+		{"", nil},
+		{"patterns.", nil},
+		{".patterns", nil},
+		{"patterns[", nil},
+		{"patterns[-1]", nil},
+		{"patterns[x]", nil},
+		{`repository["a`, nil},
+	}
+	for _, test := range tests {
+		got, err := parsePath(test.path)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%q: got %v, want an error", test.path, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v, %v, want %v", test.path, got, err, test.want)
+		}
+	}
+}
+
+func TestPatchValue(t *testing.T) {
+	const tree = `{"patterns": [{"match": "a"}, {"match": "b"}], "repository": {"s": {"patterns": [{"include": "#x"}]}}}`
+	tests := []struct {
+		name  string
+		op    string
+		path  string
+		value string
+		want  string /* empty if the patch fails */
+	}{
+		{"append", "add", "patterns", `{"match": "c"}`,
+			`{"patterns":[{"match":"a"},{"match":"b"},{"match":"c"}],"repository":{"s":{"patterns":[{"include":"#x"}]}}}`},
+		{"insert", "add", "patterns[1]", `{"match": "c"}`,
+			`{"patterns":[{"match":"a"},{"match":"c"},{"match":"b"}],"repository":{"s":{"patterns":[{"include":"#x"}]}}}`},
+		{"insert at end", "add", "repository.s.patterns[1]", `{"match": "c"}`,
+			`{"patterns":[{"match":"a"},{"match":"b"}],"repository":{"s":{"patterns":[{"include":"#x"},{"match":"c"}]}}}`},
+		{"add key", "add", "repository.s.name", `"string"`,
+			`{"patterns":[{"match":"a"},{"match":"b"}],"repository":{"s":{"name":"string","patterns":[{"include":"#x"}]}}}`},
+		{"replace nested", "replace", "repository.s.patterns[0].include", `"#y"`,
+			`{"patterns":[{"match":"a"},{"match":"b"}],"repository":{"s":{"patterns":[{"include":"#y"}]}}}`},
+		{"replace element", "replace", "patterns[0]", `{"match": "c"}`,
+			`{"patterns":[{"match":"c"},{"match":"b"}],"repository":{"s":{"patterns":[{"include":"#x"}]}}}`},
+		{"remove element", "remove", "patterns[0]", ``,
+			`{"patterns":[{"match":"b"}],"repository":{"s":{"patterns":[{"include":"#x"}]}}}`},
+		{"remove key", "remove", "repository.s", ``,
+			`{"patterns":[{"match":"a"},{"match":"b"}],"repository":{}}`},
+		{"add to non-array", "add", "patterns[0].match", `"c"`, ``},
+		{"replace missing key", "replace", "repository.t", `{}`, ``},
+		{"remove missing key", "remove", "repository.t.patterns", ``, ``},
+		{"index out of range", "replace", "patterns[2]", `{}`, ``},
+		{"key of array", "replace", "patterns.match", `"c"`, ``},
+		{"index of object", "replace", "repository[0]", `{}`, ``},
+		{"child of string", "replace", "patterns[0].match.x", `"c"`, ``},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var v, value any
+			json.Unmarshal([]byte(tree), &v)
+			if test.value != "" {
+				json.Unmarshal([]byte(test.value), &value)
+			}
+			path, err := parsePath(test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := patchValue(v, path, test.op, value)
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("got %v, want an error", got)
+				}
+				return
+			}
+			content, _ := json.Marshal(got)
+			if err != nil || string(content) != test.want {
+				t.Errorf("got %s, %v, want %s", content, err, test.want)
+			}
+		})
+	}
+}
+
+func TestOverlayApply(t *testing.T) {
+	j, err := DecodeGrammar([]byte(`{
+		"scopeName": "source.test",
+		"fileTypes": ["test"],
+		"patterns": [{"match": "a", "name": "a"}],
+		"repository": {"patterns": {"match": "b"}, "s": {"begin": "x", "end": "y"}}
+	}`), FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		patch Patch
+		err   error
+	}{
+		{"append to list", Patch{Op: "add", Path: "patterns", Value: map[string]any{"match": "c"}}, nil},
+		{"add list", Patch{Op: "add", Path: "repository.s.patterns", Value: []any{map[string]any{"match": "c"}}}, nil},
+		{"add rule to missing list", Patch{Op: "add", Path: "repository.s.patterns", Value: map[string]any{"match": "c"}}, ErrPatchValue},
+		{"replace list", Patch{Op: "replace", Path: "patterns", Value: map[string]any{"match": "c"}}, ErrPatchValue},
+		{"add capture", Patch{Op: "add", Path: "repository.s.captures", Value: map[string]any{"0": map[string]any{"name": "c"}}}, nil},
+		{"replace rule named patterns", Patch{Op: "replace", Path: "repository.patterns", Value: map[string]any{"match": "c"}}, nil},
+		{"missing target", Patch{Op: "replace", Path: "repository.t.name", Value: "c"}, ErrPatchTarget},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := &Overlay{ScopeName: "source.test", Patches: []Patch{test.patch}}
+			res, err := o.Apply(j)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got %v, want %v", err, test.err)
+			}
+			if err != nil {
+				var cerr *CompileError
+				if !errors.As(err, &cerr) || cerr.Path != test.patch.Path {
+					t.Errorf("got %v, want a *CompileError at %s", err, test.patch.Path)
+				}
+				return
+			}
+			if res.ScopeName != "source.test" || len(j.Patterns) != 1 || j.Repository["s"].Patterns != nil {
+				t.Error("Apply changed the original grammar")
+			}
+		})
+	}
+
+	syntax, err := DecodeSublimeSyntax([]byte("scope: source.sublime\ncontexts:\n  main: []\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &Overlay{ScopeName: "source.sublime", Patches: []Patch{{Op: "remove", Path: "patterns[0]"}}}
+	if _, err := o.Apply(syntax.GrammarJSON()); !errors.Is(err, ErrNotPatchable) {
+		t.Errorf("Sublime syntax: got %v, want ErrNotPatchable", err)
+	}
+}
@@ -8,24 +8,90 @@ package regexp
 // int error_code_to_str(UChar* err_buf, int err_code, OnigErrorInfo* info) {
 //     return info != NULL ? onig_error_code_to_str(err_buf, err_code, info) : onig_error_code_to_str(err_buf, err_code);
 // }
+//
+// int match_with_limits(OnigRegex reg, const UChar* str, const UChar* end, const UChar* at, OnigRegion* region, OnigOptionType option, unsigned long in_match, unsigned long in_search) {
+//     OnigMatchParam* mp = onig_new_match_param();
+//     if (mp == NULL) {
+//         return ONIGERR_MEMORY;
+//     }
+//     if (in_match != 0) {
+//         onig_set_retry_limit_in_match_of_match_param(mp, in_match);
+//     }
+//     if (in_search != 0) {
+//         onig_set_retry_limit_in_search_of_match_param(mp, in_search);
+//     }
+//     int ret = onig_match_with_param(reg, str, end, at, region, option, mp);
+//     onig_free_match_param(mp);
+//     return ret;
+// }
 import "C"
 import (
+	"errors"
 	"fmt"
+	"runtime"
+	"strings"
+	"time"
 	"unsafe"
 )
 
+var (
+	ErrRetryLimitInMatch  = errors.New("retry-limit-in-match over")
+	ErrRetryLimitInSearch = errors.New("retry-limit-in-search over")
+	ErrTimeLimit          = errors.New("time-limit over")
+	ErrFreed              = errors.New("use of freed regexp")
+)
+
 type RegexpError struct {
 	pattern string
 	message string
+	offset  int
 }
 
 func (err RegexpError) Error() string {
+	if err.offset >= 0 {
+		return fmt.Sprintf("error in `%s` at offset %d: %s", err.pattern, err.offset, err.message)
+	}
 	return fmt.Sprintf("error in `%s`: %s", err.pattern, err.message)
 }
 
+// Pattern returns the expression which caused the error.
+func (err RegexpError) Pattern() string {
+	return err.pattern
+}
+
+// Message returns the error message of Oniguruma.
+func (err RegexpError) Message() string {
+	return err.message
+}
+
+// Offset returns the byte offset of the offending part of the pattern as reported by Oniguruma,
+// or -1 if it did not report one.
+func (err RegexpError) Offset() int {
+	return err.offset
+}
+
+// LimitError is returned by a match that was aborted because it exceeded its Limits.
+// It unwraps to ErrRetryLimitInMatch, ErrRetryLimitInSearch or ErrTimeLimit.
+type LimitError struct {
+	pattern string
+	limit   error
+}
+
+func (err LimitError) Error() string {
+	return fmt.Sprintf("error in `%s`: %v", err.pattern, err.limit)
+}
+
+func (err LimitError) Unwrap() error {
+	return err.limit
+}
+
+// Regexp is a compiled expression. Its memory is owned by Oniguruma and is released
+// by Free or, if Free is never called, once the Regexp is garbage collected.
 type Regexp struct {
 	c       C.OnigRegex
 	pattern string
+	syntax  *Syntax
+	cleanup runtime.Cleanup
 }
 
 type Range struct {
@@ -73,30 +139,130 @@ const (
 	OptionMaxbit                             Option = C.ONIG_OPTION_MAXBIT
 )
 
-var syntax = C.ONIG_SYNTAX_DEFAULT
+// Limits bounds the work spent on matching. The zero Limits adds no bounds of its own.
+type Limits struct {
+	// RetryInMatch is the maximum number of backtracking retries of a single match. Zero uses
+	// the process-wide default of SetRetryLimitInMatch, which is 10000000 unless changed.
+	RetryInMatch uint
+	// RetryInSearch is the maximum number of retries summed over all positions of a search.
+	// Zero uses the process-wide default of SetRetryLimitInSearch, which is unlimited unless changed.
+	RetryInSearch uint
+	// Time is the time budget of a MatchParam, zero means no time budget. Oniguruma cannot interrupt
+	// a running match, so it is checked before every match; a single runaway match is bounded by the
+	// retry limits.
+	Time time.Duration
+}
+
+// MatchParam carries Limits across a sequence of matches, such as all matches done on one line.
+type MatchParam struct {
+	Limits
+	deadline time.Time
+}
+
+// NewMatchParam returns a MatchParam with limits; its time budget starts now.
+func NewMatchParam(limits Limits) *MatchParam {
+	param := &MatchParam{Limits: limits}
+	if limits.Time > 0 {
+		param.deadline = time.Now().Add(limits.Time)
+	}
+	return param
+}
+
+// SetRetryLimitInMatch sets the process-wide default of Limits.RetryInMatch.
+func SetRetryLimitInMatch(limit uint) {
+	C.onig_set_retry_limit_in_match(C.ulong(limit))
+}
+
+// SetRetryLimitInSearch sets the process-wide default of Limits.RetryInSearch, zero means unlimited.
+func SetRetryLimitInSearch(limit uint) {
+	C.onig_set_retry_limit_in_search(C.ulong(limit))
+}
 
+// Syntax is a regular expression dialect understood by Oniguruma.
+type Syntax struct {
+	c    *C.OnigSyntaxType
+	name string
+}
+
+var (
+	SyntaxDefault   = &Syntax{C.ONIG_SYNTAX_DEFAULT, "Default"}
+	SyntaxOniguruma = &Syntax{&C.OnigSyntaxOniguruma, "Oniguruma"}
+	SyntaxRuby      = &Syntax{&C.OnigSyntaxRuby, "Ruby"}
+	SyntaxPerl      = &Syntax{&C.OnigSyntaxPerl, "Perl"}
+	SyntaxPerlNG    = &Syntax{&C.OnigSyntaxPerl_NG, "Perl_NG"}
+	SyntaxPython    = &Syntax{&C.OnigSyntaxPython, "Python"}
+	SyntaxJava      = &Syntax{&C.OnigSyntaxJava, "Java"}
+)
+
+var syntaxes = []*Syntax{SyntaxDefault, SyntaxOniguruma, SyntaxRuby, SyntaxPerl, SyntaxPerlNG, SyntaxPython, SyntaxJava}
+
+// SyntaxByName looks up a syntax by its case-insensitive name, such as "ruby" or "perl_ng".
+func SyntaxByName(name string) (*Syntax, bool) {
+	for _, syn := range syntaxes {
+		if strings.EqualFold(syn.name, name) {
+			return syn, true
+		}
+	}
+	return nil, false
+}
+
+func (syn *Syntax) String() string {
+	return syn.name
+}
+
+// Compile compiles pattern using SyntaxDefault.
 func Compile(pattern string, option Option) (*Regexp, error) {
-	r := Regexp{pattern: pattern}
-	bytes := []byte(pattern)
+	return CompileSyntax(pattern, option, SyntaxDefault)
+}
+
+// CompileSyntax compiles pattern in the given dialect, nil meaning SyntaxDefault.
+func CompileSyntax(pattern string, option Option, syntax *Syntax) (*Regexp, error) {
+	if syntax == nil {
+		syntax = SyntaxDefault
+	}
+	r := Regexp{pattern: pattern, syntax: syntax}
+	/* one byte more, so that the end pointer stays within the allocation */
+	bytes := make([]byte, len(pattern), len(pattern)+1)
+	copy(bytes, pattern)
 	if len(bytes) == 0 {
-		return nil, RegexpError{"<empty>", "empty pattern"}
+		return nil, RegexpError{"<empty>", "empty pattern", -1}
 	}
 	start := (*C.OnigUChar)(unsafe.Pointer(&bytes[0]))
 	end := (*C.OnigUChar)(unsafe.Pointer(uintptr(unsafe.Pointer(&bytes[0])) + uintptr(len(bytes))))
 
+	/* errinfo may point into the pattern, which therefore has to be pinned */
+	var pinner runtime.Pinner
+	pinner.Pin(&bytes[0])
+	defer pinner.Unpin()
+
 	var errinfo C.OnigErrorInfo
 
-	ret := C.onig_new(&r.c, start, end, C.OnigOptionType(option), C.ONIG_ENCODING_UTF8, syntax, &errinfo)
+	ret := C.onig_new(&r.c, start, end, C.OnigOptionType(option), C.ONIG_ENCODING_UTF8, syntax.c, &errinfo)
 	if ret != C.ONIG_NORMAL {
 		var errBuf [C.ONIG_MAX_ERROR_MESSAGE_LEN]C.char
 		C.error_code_to_str((*C.OnigUChar)(unsafe.Pointer(&errBuf[0])), ret, &errinfo)
-		return nil, RegexpError{pattern, C.GoString(&errBuf[0])}
+		offset := -1
+		if errinfo.par != nil {
+			offset = int(uintptr(unsafe.Pointer(errinfo.par)) - uintptr(unsafe.Pointer(&bytes[0])))
+		}
+		return nil, RegexpError{pattern, C.GoString(&errBuf[0]), offset}
 	}
+	r.cleanup = runtime.AddCleanup(&r, freeRegex, r.c)
 
 	return &r, nil
 }
 
+func freeRegex(c C.OnigRegex) {
+	C.onig_free(c)
+}
+
+// Free releases the expression immediately, further matches fail with ErrFreed.
+// Calling Free more than once is harmless.
 func (re *Regexp) Free() {
+	if re.c == nil {
+		return
+	}
+	re.cleanup.Stop()
 	C.onig_free(re.c)
 	re.c = nil
 }
@@ -105,14 +271,33 @@ func (re *Regexp) String() string {
 	return re.pattern
 }
 
+// Syntax returns the dialect the expression was compiled in.
+func (re *Regexp) Syntax() *Syntax {
+	return re.syntax
+}
+
 func (re *Regexp) Match(text string, from int, to int, options Option) ([]Range, error) {
+	return re.MatchWithParam(text, from, to, options, nil)
+}
+
+// MatchWithParam is Match bounded by the limits in param, which may be nil.
+// A match exceeding these limits fails with a LimitError.
+func (re *Regexp) MatchWithParam(text string, from int, to int, options Option, param *MatchParam) ([]Range, error) {
+	if re.c == nil {
+		return nil, ErrFreed
+	}
 	if len(text) == 0 {
 		return nil, nil
 	}
 	if to == 0 {
 		to = len(text)
 	}
-	bytes := []byte(text)
+	if param != nil && !param.deadline.IsZero() && time.Now().After(param.deadline) {
+		return nil, LimitError{re.pattern, ErrTimeLimit}
+	}
+	/* one byte more, so that the end pointer stays within the allocation */
+	bytes := make([]byte, len(text)+1)
+	copy(bytes, text)
 	cpattern := (*C.OnigUChar)(unsafe.Pointer(&bytes[0]))
 	start := (*C.OnigUChar)(unsafe.Pointer(uintptr(unsafe.Pointer(&bytes[0])) + uintptr(from)))
 	end := (*C.OnigUChar)(unsafe.Pointer(uintptr(unsafe.Pointer(&bytes[0])) + uintptr(to)))
@@ -120,13 +305,26 @@ func (re *Regexp) Match(text string, from int, to int, options Option) ([]Range,
 	region := C.onig_region_new()
 	defer C.onig_region_free(region, 1)
 
-	ret := C.onig_match(re.c, cpattern, end, start, region, C.OnigOptionType(options))
-	if ret == C.ONIG_MISMATCH {
+	var ret C.int
+	if param == nil {
+		ret = C.onig_match(re.c, cpattern, end, start, region, C.OnigOptionType(options))
+	} else {
+		ret = C.match_with_limits(re.c, cpattern, end, start, region, C.OnigOptionType(options), C.ulong(param.RetryInMatch), C.ulong(param.RetryInSearch))
+	}
+	/* re.c must not be freed by the cleanup while oniguruma is using it */
+	runtime.KeepAlive(re)
+	switch ret {
+	case C.ONIG_MISMATCH:
 		return nil, nil
-	} else if ret < 0 {
+	case C.ONIGERR_RETRY_LIMIT_IN_MATCH_OVER:
+		return nil, LimitError{re.pattern, ErrRetryLimitInMatch}
+	case C.ONIGERR_RETRY_LIMIT_IN_SEARCH_OVER:
+		return nil, LimitError{re.pattern, ErrRetryLimitInSearch}
+	}
+	if ret < 0 {
 		var errBuf [C.ONIG_MAX_ERROR_MESSAGE_LEN]C.char
 		C.error_code_to_str((*C.OnigUChar)(unsafe.Pointer(&errBuf[0])), ret, nil)
-		return nil, RegexpError{re.pattern, C.GoString(&errBuf[0])}
+		return nil, RegexpError{re.pattern, C.GoString(&errBuf[0]), -1}
 	}
 
 	groups := make([]Range, region.num_regs)
@@ -0,0 +1,28 @@
+package regexp
+
+import "testing"
+
+func TestSyntaxByName(t *testing.T) {
+	tests := []struct {
+		name string
+		want *Syntax /* nil if unknown */
+	}{
+		{"default", SyntaxDefault},
+		{"Oniguruma", SyntaxOniguruma},
+		{"RUBY", SyntaxRuby},
+		{"perl", SyntaxPerl},
+		{"perl_ng", SyntaxPerlNG},
+		{"Perl_NG", SyntaxPerlNG},
+		{"python", SyntaxPython},
+		{"java", SyntaxJava},
+		{"perl_nt", nil},
+		{"perl ng", nil},
+		{"", nil},
+	}
+	for _, test := range tests {
+		got, ok := SyntaxByName(test.name)
+		if got != test.want || ok != (test.want != nil) {
+			t.Errorf("SyntaxByName(%q) = %v, %v, want %v", test.name, got, ok, test.want)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package textmate
+
+import (
+	"archive/zip"
+	"cmp"
+	"context"
+	"errors"
+	"io/fs"
+	"maps"
+	"slices"
+	"time"
+)
+
+// fileSource is the file a grammar was loaded from, as it was when loaded.
+type fileSource struct {
+	fsys     fs.FS
+	name     string
+	size     int64
+	modTime  time.Time
+	declared bool           /* the metadata was declared by a manifest, only the rules are reloaded */
+	archive  *archiveSource /* archive the file was read from, which is reloaded as a whole */
+}
+
+// archiveSource is the archive grammars were loaded from, as it was when loaded.
+type archiveSource struct {
+	fileSource
+	pathname string
+	tier     Tier
+}
+
+// changed reports whether the file differs from info, judged by its size and modification time.
+func (src *fileSource) changed(info fs.FileInfo) bool {
+	return info.Size() != src.size || !info.ModTime().Equal(src.modTime)
+}
+
+// Subscribe calls fn after every Reload which changed grammars, with the scopes as returned by
+// Reload. fn is called without locks held, so it may obtain the new grammars from the loader.
+// The returned function cancels the subscription.
+func (l *Loader) Subscribe(fn func(scopes []string)) (cancel func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sub := &fn
+	l.subscribers = append(l.subscribers, sub)
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.subscribers = slices.DeleteFunc(l.subscribers, func(other *func([]string)) bool {
+			return other == sub
+		})
+	}
+}
+
+// Reload reads the grammar files which changed since they were loaded, judged by their size and
+// modification time, and drops grammars whose file was removed. It returns the scopes of these
+// grammars, followed by the scopes of compiled grammars including them; the compiled grammars
+// are recompiled by the next FromScope and the like, grammars obtained before keep their rules.
+//
+// Archives are reloaded as a whole: the grammars of a changed archive are replaced by the
+// grammars it contains now, which take precedence over other grammars of the same tier like
+// newly added ones. Overlay files given by WithOverlayFile are read again as well.
+//
+// A file which fails to load keeps its previous grammar or overlay, the error is the Diagnostics
+// found by this reload. Grammars registered at runtime are left as-is, new files are not looked for.
+func (l *Loader) Reload() ([]string, error) {
+	l.mu.Lock()
+	n := len(l.diags)
+	scopes := l.reload()
+	subscribers := slices.Clone(l.subscribers)
+	var err error
+	if len(l.diags) > n {
+		err = slices.Clone(l.diags[n:])
+	}
+	l.unlock()
+
+	if len(scopes) > 0 {
+		for _, fn := range subscribers {
+			(*fn)(slices.Clone(scopes))
+		}
+	}
+	return scopes, err
+}
+
+// Watch calls Reload every interval until ctx is done, problems are reported to the logger
+// given by WithLogger:
+//
+//	go loader.Watch(ctx, time.Second)
+func (l *Loader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.Reload()
+		}
+	}
+}
+
+// reload replaces the grammars whose file changed and returns the affected scopes, l.mu must be held.
+func (l *Loader) reload() []string {
+	scopes := l.reloadOverlays()
+	archives := make(map[*archiveSource]*zip.Reader) /* replaced archives, nil if removed */
+	checked := make(map[*archiveSource]bool)
+	var dropped []string
+	grammars := l.grammars[:0]
+	for _, grm := range l.grammars {
+		if grm.source != nil && grm.source.archive != nil {
+			a := grm.source.archive
+			if !checked[a] {
+				checked[a] = true
+				if archive, ok := l.reloadArchive(a); ok {
+					archives[a] = archive
+				}
+			}
+			if _, ok := archives[a]; !ok {
+				grammars = append(grammars, grm)
+				continue
+			}
+			if !slices.Contains(scopes, grm.ScopeName) {
+				scopes = append(scopes, grm.ScopeName)
+			}
+			dropped = append(dropped, grm.ScopeName)
+			continue
+		}
+		next, ok := l.reloadFile(grm)
+		if !ok {
+			grammars = append(grammars, grm)
+			continue
+		}
+		if !slices.Contains(scopes, grm.ScopeName) {
+			scopes = append(scopes, grm.ScopeName)
+		}
+		if next == nil {
+			continue
+		}
+		if !slices.Contains(scopes, next.ScopeName) {
+			scopes = append(scopes, next.ScopeName)
+		}
+		grammars = append(grammars, next)
+	}
+	clear(l.grammars[len(grammars):])
+	l.grammars = grammars
+	if len(archives) > 0 {
+		scopes = l.readdArchives(archives, dropped, scopes)
+	}
+	if len(scopes) == 0 {
+		return nil
+	}
+
+	/* dependents are recompiled, as they may refer to rules which changed */
+	for i := 0; i < len(scopes); i++ {
+		for grm, comp := range l.cache {
+			if slices.Contains(comp.includes, scopes[i]) && !slices.Contains(scopes, grm.ScopeName) {
+				scopes = append(scopes, grm.ScopeName)
+			}
+		}
+	}
+	for grm := range l.cache {
+		if slices.Contains(scopes, grm.ScopeName) {
+			delete(l.cache, grm)
+		}
+	}
+	l.gen++
+	l.reindex()
+	pruned := false
+	for _, scope := range scopes {
+		if l.winner(scope) == nil {
+			l.dropContribution(scope)
+			pruned = true
+		}
+	}
+	if pruned {
+		l.buildLanguages()
+	}
+	l.saveCache()
+	return scopes
+}
+
+// reloadFile reads the file of grm again if it changed. ok is set if grm is to be replaced by
+// next, which is nil if the file was removed.
+func (l *Loader) reloadFile(grm *GrammarJSON) (next *GrammarJSON, ok bool) {
+	src := grm.source
+	if src == nil {
+		return nil, false
+	}
+	info, err := fs.Stat(src.fsys, src.name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, true
+	}
+	if err != nil {
+		l.diagnose(Diagnostic{Path: grm.filename, Scope: grm.ScopeName, Err: err})
+		return nil, false
+	}
+	if !src.changed(info) {
+		return nil, false
+	}
+	next, err = l.loadFile(src.fsys, src.name, grm.filename)
+	if err == nil && next.ScopeName == "" && !src.declared {
+		err = ErrMissingScopeName
+	}
+	if err != nil {
+		/* reported once, until the file changes again */
+		src.size, src.modTime = info.Size(), info.ModTime()
+		l.diagnose(Diagnostic{Path: grm.filename, Scope: grm.ScopeName, Err: err})
+		return nil, false
+	}
+	if src.declared {
+		full := next
+		next = &GrammarJSON{
+			Name:      grm.Name,
+			ScopeName: grm.ScopeName,
+			FileTypes: grm.FileTypes,
+			FirstLine: grm.FirstLine,
+			filename:  grm.filename,
+			source:    full.source,
+			body:      full.decoded,
+		}
+		next.source.declared = true
+	}
+	next.tier = grm.tier
+	next.seq = grm.seq
+	return next, true
+}
+
+// reloadArchive checks whether the archive a changed. ok is set if its grammars are to be
+// replaced by those in archive, which is nil if the file was removed; a is updated to the new file.
+func (l *Loader) reloadArchive(a *archiveSource) (archive *zip.Reader, ok bool) {
+	info, err := fs.Stat(a.fsys, a.name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, true
+	}
+	if err != nil {
+		l.diagnose(Diagnostic{Path: a.pathname, Err: err})
+		return nil, false
+	}
+	if !a.changed(info) {
+		return nil, false
+	}
+	archive, src, err := openArchive(a.fsys, a.name)
+	if err != nil {
+		/* reported once, until the file changes again */
+		a.size, a.modTime = info.Size(), info.ModTime()
+		l.diagnose(Diagnostic{Path: a.pathname, Err: err})
+		return nil, false
+	}
+	a.size, a.modTime = src.size, src.modTime
+	return archive, true
+}
+
+// readdArchives adds the grammars of the replaced archives, whose previous grammars named
+// dropped were removed, and returns scopes with the scopes of the new grammars.
+func (l *Loader) readdArchives(archives map[*archiveSource]*zip.Reader, dropped []string, scopes []string) []string {
+	for _, scope := range dropped {
+		l.dropContribution(scope)
+		l.globs = slices.DeleteFunc(l.globs, func(glob fileGlob) bool {
+			return glob.scope == scope
+		})
+	}
+	sources := slices.SortedFunc(maps.Keys(archives), func(a, b *archiveSource) int {
+		return cmp.Compare(a.pathname, b.pathname)
+	})
+	prev := l.tier
+	for _, a := range sources {
+		archive := archives[a]
+		if archive == nil {
+			continue
+		}
+		n := len(l.grammars)
+		l.tier = a.tier
+		l.addArchiveFS(archive, a)
+		for _, grm := range l.grammars[n:] {
+			if !slices.Contains(scopes, grm.ScopeName) {
+				scopes = append(scopes, grm.ScopeName)
+			}
+		}
+	}
+	l.tier = prev
+	return scopes
+}
+
+// reloadOverlays reads the overlay files which changed and returns the scopes of the grammars
+// they apply to, before and after.
+func (l *Loader) reloadOverlays() []string {
+	var scopes []string
+	overlays := l.overlays[:0]
+	for _, lo := range l.overlays {
+		if lo.file == nil {
+			overlays = append(overlays, lo)
+			continue
+		}
+		prev := lo.Overlay
+		info, err := fs.Stat(lo.file.fsys, lo.file.name)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			lo = nil
+		case err != nil:
+			l.diagnose(Diagnostic{Path: lo.file.name, Err: err})
+		case lo.file.changed(info):
+			l.loadOverlay(lo, info)
+		}
+		var next *Overlay
+		if lo != nil {
+			next = lo.Overlay
+			overlays = append(overlays, lo)
+		}
+		if next == prev {
+			continue
+		}
+		for _, o := range []*Overlay{prev, next} {
+			if o != nil && !slices.Contains(scopes, o.ScopeName) {
+				scopes = append(scopes, o.ScopeName)
+			}
+		}
+	}
+	clear(l.overlays[len(overlays):])
+	l.overlays = overlays
+	return scopes
+}
@@ -0,0 +1,210 @@
+package textmate
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// writeFile writes content to name, with a modification time after the previous one so
+// that Reload notices the change.
+func writeFile(t *testing.T, name string, content []byte) {
+	t.Helper()
+	modTime := time.Now()
+	if info, err := os.Stat(name); err == nil {
+		modTime = info.ModTime().Add(time.Second)
+	}
+	if err := os.WriteFile(name, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// zipFiles returns a zip archive of files.
+func zipFiles(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// keywordGrammar is a grammar named scope which scopes word as a keyword.
+func keywordGrammar(scope string, word string) string {
+	return `{"scopeName": "` + scope + `", "patterns": [{"match": "\\b` + word + `\\b", "name": "keyword"}]}`
+}
+
+// tokenizes reports whether the grammar named scope scopes text as a keyword.
+func tokenizes(t *testing.T, l *Loader, scope string, text string) bool {
+	t.Helper()
+	g, err := l.FromScope(scope)
+	if err != nil {
+		t.Fatalf("FromScope(%s): %v", scope, err)
+	}
+	return slices.Equal(scopes(t, g, text), []string{"keyword:" + text})
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.json"), []byte(keywordGrammar("source.a", "if")))
+	writeFile(t, filepath.Join(dir, "b.json"), []byte(keywordGrammar("source.b", "if")))
+	l, ok := NewLoaderFromDir(dir, false)
+	if !ok {
+		t.Fatal("no grammars loaded")
+	}
+	var notified [][]string
+	cancel := l.Subscribe(func(scopes []string) {
+		notified = append(notified, scopes)
+	})
+	defer cancel()
+
+	tests := []struct {
+		name   string
+		change func()
+		want   []string
+		err    bool
+	}{
+		{"unchanged", func() {}, nil, false},
+		{"changed", func() {
+			writeFile(t, filepath.Join(dir, "a.json"), []byte(keywordGrammar("source.a", "while")))
+		}, []string{"source.a"}, false},
+		{"broken", func() {
+			writeFile(t, filepath.Join(dir, "a.json"), []byte(`{"scopeName": `))
+		}, nil, true},
+		{"broken again", func() {}, nil, false},
+		{"removed", func() {
+			os.Remove(filepath.Join(dir, "b.json"))
+		}, []string{"source.b"}, false},
+	}
+	for _, test := range tests {
+		test.change()
+		got, err := l.Reload()
+		if !slices.Equal(got, test.want) || (err != nil) != test.err {
+			t.Errorf("%s: Reload = %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+	/* the broken file keeps the grammar it replaced */
+	if !tokenizes(t, l, "source.a", "while") {
+		t.Error("source.a was not reloaded")
+	}
+	if _, err := l.FromScope("source.b"); err == nil {
+		t.Error("source.b was not dropped")
+	}
+	if len(notified) != 2 {
+		t.Errorf("subscriber notified of %q, want 2 reloads", notified)
+	}
+}
+
+func TestReloadArchive(t *testing.T) {
+	dir := t.TempDir()
+	pkg := filepath.Join(dir, "test.sublime-package")
+	writeFile(t, pkg, zipFiles(t, map[string]string{"a.tmLanguage.json": keywordGrammar("source.a", "if")}))
+	l, ok := NewLoaderFromDir(dir, false)
+	if !ok {
+		t.Fatal("no grammars loaded")
+	}
+
+	tests := []struct {
+		name   string
+		change func()
+		want   []string
+		err    bool
+	}{
+		{"unchanged", func() {}, nil, false},
+		{"replaced", func() {
+			writeFile(t, pkg, zipFiles(t, map[string]string{
+				"a.tmLanguage.json": keywordGrammar("source.a", "while"),
+				"b.tmLanguage.json": keywordGrammar("source.b", "if"),
+			}))
+		}, []string{"source.a", "source.b"}, false},
+		{"not an archive", func() {
+			writeFile(t, pkg, []byte("not a zip archive"))
+		}, nil, true},
+		{"not an archive again", func() {}, nil, false},
+		{"shrunk", func() {
+			writeFile(t, pkg, zipFiles(t, map[string]string{"b.tmLanguage.json": keywordGrammar("source.b", "for")}))
+		}, []string{"source.a", "source.b"}, false},
+		{"removed", func() {
+			os.Remove(pkg)
+		}, []string{"source.b"}, false},
+	}
+	for _, test := range tests {
+		test.change()
+		got, err := l.Reload()
+		slices.Sort(got)
+		if !slices.Equal(got, test.want) || (err != nil) != test.err {
+			t.Errorf("%s: Reload = %q, %v, want %q", test.name, got, err, test.want)
+		}
+		switch test.name {
+		case "replaced", "not an archive":
+			if !tokenizes(t, l, "source.a", "while") || !tokenizes(t, l, "source.b", "if") {
+				t.Errorf("%s: archive grammars not replaced", test.name)
+			}
+		case "shrunk":
+			if l.hasScope("source.a") || !tokenizes(t, l, "source.b", "for") {
+				t.Errorf("%s: archive grammars not replaced", test.name)
+			}
+		}
+	}
+	if l.hasScope("source.b") {
+		t.Error("grammars of the removed archive remain")
+	}
+}
+
+func TestReloadOverlayFile(t *testing.T) {
+	dir := t.TempDir()
+	overlay := func(word string) []byte {
+		return []byte(`{"scopeName": "source.a", "patches": [{"op": "replace", "path": "patterns[0].match", "value": "\\b` + word + `\\b"}]}`)
+	}
+	writeFile(t, filepath.Join(dir, "a.json"), []byte(keywordGrammar("source.a", "if")))
+	name := filepath.Join(t.TempDir(), "overlay.json")
+	writeFile(t, name, overlay("while"))
+	l, ok := NewLoaderFromDir(dir, false, WithOverlayFile(name))
+	if !ok {
+		t.Fatal("no grammars loaded")
+	}
+
+	tests := []struct {
+		name    string
+		change  func()
+		scopes  []string
+		keyword string /* keyword of source.a after reloading */
+		err     bool
+	}{
+		{"unchanged", func() {}, nil, "while", false},
+		{"changed", func() {
+			writeFile(t, name, overlay("for"))
+		}, []string{"source.a"}, "for", false},
+		{"broken", func() {
+			writeFile(t, name, []byte(`{"scopeName": `))
+		}, nil, "for", true},
+		{"removed", func() {
+			os.Remove(name)
+		}, []string{"source.a"}, "if", false},
+	}
+	for _, test := range tests {
+		test.change()
+		got, err := l.Reload()
+		if !slices.Equal(got, test.scopes) || (err != nil) != test.err {
+			t.Errorf("%s: Reload = %q, %v, want %q", test.name, got, err, test.scopes)
+		}
+		if !tokenizes(t, l, "source.a", test.keyword) {
+			t.Errorf("%s: %s is not a keyword", test.name, test.keyword)
+		}
+	}
+}
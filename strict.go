@@ -0,0 +1,271 @@
+package textmate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"slices"
+
+	"go.yaml.in/yaml/v3"
+	"howett.net/plist"
+)
+
+var (
+	ErrUnknownKey     = errors.New("unknown key")
+	ErrUnsupportedKey = errors.New("unsupported key")
+	ErrIgnoredKey     = errors.New("ignored key")
+)
+
+// KeyError locates a key which is ignored when decoding a grammar. Err is ErrUnknownKey,
+// ErrUnsupportedKey for features of TextMate or Sublime Text which are not implemented, or
+// ErrIgnoredKey for metadata which does not affect highlighting.
+type KeyError struct {
+	// Path is the JSON path of the key, such as `repository.strings.contentName`.
+	Path string
+	Err  error
+}
+
+func (err *KeyError) Error() string {
+	return fmt.Sprintf("%s: %v", err.Path, err.Err)
+}
+
+func (err *KeyError) Unwrap() error {
+	return err.Err
+}
+
+// keyKind tells how a key of a grammar is decoded.
+type keyKind int
+
+const (
+	keyUnknown keyKind = iota
+	keyKnown
+	keyUnsupported
+	keyIgnored /* metadata which does not affect highlighting */
+)
+
+var (
+	grammarKeys = map[string]keyKind{
+		"name": keyKnown, "scopeName": keyKnown, "fileTypes": keyKnown, "foldingStartMarker": keyKnown,
+		"foldingStopMarker": keyKnown, "firstLineMatch": keyKnown, "patterns": keyKnown, "repository": keyKnown,
+		"injections": keyUnsupported, "injectionSelector": keyUnsupported,
+		"$schema": keyIgnored, "uuid": keyIgnored, "comment": keyIgnored, "version": keyIgnored,
+		"information_for_contributors": keyIgnored, "keyEquivalent": keyIgnored, "hideFromUser": keyIgnored,
+	}
+	ruleKeys = map[string]keyKind{
+		"name": keyKnown, "match": keyKnown, "begin": keyKnown, "end": keyKnown, "while": keyKnown,
+		"patterns": keyKnown, "captures": keyKnown, "beginCaptures": keyKnown, "endCaptures": keyKnown, "include": keyKnown,
+		"disabled": keyKnown, "comment": keyKnown,
+		"contentName": keyUnsupported, "applyEndPatternLast": keyUnsupported, "whileCaptures": keyUnsupported,
+		"repository": keyUnsupported,
+	}
+	/* captures only scope their text and apply their patterns to it */
+	captureKeys = map[string]keyKind{
+		"name": keyKnown, "patterns": keyKnown, "disabled": keyKnown, "comment": keyKnown,
+	}
+	sublimeKeys = map[string]keyKind{
+		"name": keyKnown, "scope": keyKnown, "file_extensions": keyKnown, "first_line_match": keyKnown,
+		"hidden": keyKnown, "variables": keyKnown, "contexts": keyKnown,
+		"extends": keyUnsupported, "hidden_file_extensions": keyUnsupported,
+		"version": keyIgnored,
+	}
+	sublimeRuleKeys = map[string]keyKind{
+		"match": keyKnown, "scope": keyKnown, "captures": keyKnown, "push": keyKnown, "set": keyKnown,
+		"pop": keyKnown, "embed": keyKnown, "embed_scope": keyKnown, "escape": keyKnown,
+		"escape_captures": keyKnown, "include": keyKnown, "meta_scope": keyKnown,
+		"meta_content_scope": keyKnown, "meta_include_prototype": keyKnown,
+		"branch_point": keyUnsupported, "fail": keyUnsupported, "with_prototype": keyUnsupported,
+		"clear_scopes": keyUnsupported, "apply_prototype": keyUnsupported,
+		"meta_prepend": keyUnsupported, "meta_append": keyUnsupported,
+		"comment": keyIgnored,
+	}
+)
+
+// WithStrictDecode reports every key of grammar files which is ignored as a diagnostic wrapping a
+// *KeyError, see CheckGrammarKeys. Grammar files are then read in full, even if they are cached
+// or decoded lazily. Grammars added by Register are checked as well, those added by
+// RegisterGrammar or built by GrammarBuilder are decoded already and have no keys to check.
+func WithStrictDecode() LoaderOption {
+	return func(l *Loader) {
+		l.strict = true
+	}
+}
+
+// CheckGrammarKeys reports every key of the grammar in content, written in format, which is
+// ignored by DecodeGrammar. Metadata such as `uuid` and `comment` is not reported.
+func CheckGrammarKeys(content []byte, format Format) ([]*KeyError, error) {
+	return checkGrammarKeys(content, format, keyChecker{})
+}
+
+// DroppedKeys reports every key of the grammar in content, written in format, which is lost
+// when it is decoded and encoded again: the keys reported by CheckGrammarKeys, and metadata
+// such as `uuid` and `comment` wrapping ErrIgnoredKey.
+func DroppedKeys(content []byte, format Format) ([]*KeyError, error) {
+	return checkGrammarKeys(content, format, keyChecker{ignored: true})
+}
+
+// checkGrammarKeys reports the keys of the grammar in content found by c.
+func checkGrammarKeys(content []byte, format Format, c keyChecker) ([]*KeyError, error) {
+	var tree any
+	var err error
+	switch format {
+	case FormatJSON:
+		err = json.Unmarshal(content, &tree)
+	case FormatPlist:
+		_, err = plist.Unmarshal(content, &tree)
+	case FormatYAML:
+		err = yaml.Unmarshal(stripYAMLDirective(content), &tree)
+	default:
+		err = unknownFormat(format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := jsonValue(tree).(map[string]any); ok {
+		c.keys(m, "", grammarKeys)
+		c.rules(m["patterns"], "patterns")
+		if repo, ok := m["repository"].(map[string]any); ok {
+			for _, name := range slices.Sorted(maps.Keys(repo)) {
+				c.rule(repo[name], jsonPath("repository", name))
+			}
+		}
+	}
+	return c.errs, nil
+}
+
+// CheckSublimeKeys reports every key of the Sublime syntax in content which is ignored by
+// DecodeSublimeSyntax, see CheckGrammarKeys.
+func CheckSublimeKeys(content []byte) ([]*KeyError, error) {
+	var tree any
+	if err := yaml.Unmarshal(stripYAMLDirective(content), &tree); err != nil {
+		return nil, err
+	}
+	var c keyChecker
+	if m, ok := jsonValue(tree).(map[string]any); ok {
+		c.keys(m, "", sublimeKeys)
+		if contexts, ok := m["contexts"].(map[string]any); ok {
+			for _, name := range slices.Sorted(maps.Keys(contexts)) {
+				c.sublimeRules(contexts[name], jsonPath("contexts", name))
+			}
+		}
+	}
+	return c.errs, nil
+}
+
+// checkKeys reports the ignored keys of the grammar named name in fsys as diagnostics.
+func (l *Loader) checkKeys(fsys fs.FS, name string, pathname string, scope string) {
+	content, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		l.diagnose(Diagnostic{Path: pathname, Scope: scope, Err: err})
+		return
+	}
+	var errs []*KeyError
+	if hasExt(name, sublimeExts) {
+		errs, err = CheckSublimeKeys(content)
+	} else {
+		errs, err = CheckGrammarKeys(content, DetectFormat(name, content))
+	}
+	if err != nil {
+		l.diagnose(Diagnostic{Path: pathname, Scope: scope, Err: err})
+		return
+	}
+	for _, err := range errs {
+		l.diagnose(Diagnostic{Path: pathname, Scope: scope, Err: err})
+	}
+}
+
+// keyChecker collects the ignored keys of a decoded grammar.
+type keyChecker struct {
+	errs    []*KeyError
+	ignored bool /* report metadata as well */
+}
+
+// keys reports the keys of m at path which are unknown or unsupported.
+func (c *keyChecker) keys(m map[string]any, path string, known map[string]keyKind) {
+	for _, key := range slices.Sorted(maps.Keys(m)) {
+		switch known[key] {
+		case keyUnknown:
+			c.errs = append(c.errs, &KeyError{Path: jsonPath(path, key), Err: ErrUnknownKey})
+		case keyUnsupported:
+			c.errs = append(c.errs, &KeyError{Path: jsonPath(path, key), Err: ErrUnsupportedKey})
+		case keyIgnored:
+			if c.ignored {
+				c.errs = append(c.errs, &KeyError{Path: jsonPath(path, key), Err: ErrIgnoredKey})
+			}
+		}
+	}
+}
+
+// rules checks a patterns-list found at path.
+func (c *keyChecker) rules(v any, path string) {
+	rules, _ := v.([]any)
+	for i, r := range rules {
+		c.rule(r, fmt.Sprintf("%s[%d]", path, i))
+	}
+}
+
+// rule checks a rule and the rules nested in it.
+func (c *keyChecker) rule(v any, path string) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return
+	}
+	c.keys(m, path, ruleKeys)
+	c.rules(m["patterns"], jsonPath(path, "patterns"))
+	for _, key := range []string{"captures", "beginCaptures", "endCaptures"} {
+		captures, _ := m[key].(map[string]any)
+		for _, num := range slices.Sorted(maps.Keys(captures)) {
+			if capture, ok := captures[num].(map[string]any); ok {
+				c.capture(capture, jsonPath(jsonPath(path, key), num))
+			}
+		}
+	}
+}
+
+// capture checks a capture, keys of rules are unsupported there.
+func (c *keyChecker) capture(m map[string]any, path string) {
+	for _, key := range slices.Sorted(maps.Keys(m)) {
+		if captureKeys[key] != keyUnknown {
+			continue
+		}
+		err := ErrUnknownKey
+		if ruleKeys[key] != keyUnknown {
+			err = ErrUnsupportedKey
+		}
+		c.errs = append(c.errs, &KeyError{Path: jsonPath(path, key), Err: err})
+	}
+	c.rules(m["patterns"], jsonPath(path, "patterns"))
+}
+
+// sublimeRules checks the rules of a Sublime context found at path.
+func (c *keyChecker) sublimeRules(v any, path string) {
+	rules, _ := v.([]any)
+	for i, r := range rules {
+		m, ok := r.(map[string]any)
+		if !ok {
+			continue
+		}
+		rpath := fmt.Sprintf("%s[%d]", path, i)
+		c.keys(m, rpath, sublimeRuleKeys)
+		c.sublimeTargets(m["push"], jsonPath(rpath, "push"))
+		c.sublimeTargets(m["set"], jsonPath(rpath, "set"))
+	}
+}
+
+// sublimeTargets checks the anonymous contexts of push or set, which are decoded like SublimeContexts.
+func (c *keyChecker) sublimeTargets(v any, path string) {
+	targets, ok := v.([]any)
+	if !ok {
+		return
+	}
+	if len(targets) > 0 {
+		if _, ok := targets[0].(map[string]any); ok {
+			c.sublimeRules(targets, path)
+			return
+		}
+	}
+	for i, target := range targets {
+		c.sublimeTargets(target, fmt.Sprintf("%s[%d]", path, i))
+	}
+}
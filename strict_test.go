@@ -0,0 +1,116 @@
+package textmate
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"testing/fstest"
+)
+
+// keyErrors formats errs as `path: err` for comparison.
+func keyErrors(errs []*KeyError) []string {
+	var res []string
+	for _, err := range errs {
+		res = append(res, err.Error())
+	}
+	return res
+}
+
+func TestCheckGrammarKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		grammar string
+		want    []string
+	}{
+		{"known", testGrammar, nil},
+		{"metadata", `{"scopeName": "source.test", "uuid": "x", "comment": "c", "patterns": [{"match": "a", "comment": "c"}]}`, nil},
+		{"unknown", `{"scopeName": "source.test", "scopename": "x"}`, []string{"scopename: unknown key"}},
+		{"unsupported", `{"scopeName": "source.test", "injections": {}, "patterns": [{"begin": "a", "end": "b", "contentName": "c"}]}`,
+			[]string{"injections: unsupported key", "patterns[0].contentName: unsupported key"}},
+		{"repository", `{"scopeName": "source.test", "repository": {"a.b": {"patterns": [{"matches": "a"}]}}}`,
+			[]string{`repository["a.b"].patterns[0].matches: unknown key`}},
+		{"captures", `{"scopeName": "source.test", "patterns": [{"match": "a", "captures": {"1": {"name": "n", "match": "b", "x": 1}}}]}`,
+			[]string{"patterns[0].captures.1.match: unsupported key", "patterns[0].captures.1.x: unknown key"}},
+		{"capture patterns", `{"scopeName": "source.test", "patterns": [{"match": "a", "captures": {"0": {"patterns": [{"while": "b", "whileCaptures": {}}]}}}]}`,
+			[]string{"patterns[0].captures.0.patterns[0].whileCaptures: unsupported key"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errs, err := CheckGrammarKeys([]byte(test.grammar), FormatJSON)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := keyErrors(errs); !slices.Equal(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+	if _, err := CheckGrammarKeys([]byte(`{"scopeName": `), FormatJSON); err == nil {
+		t.Error("invalid JSON: no error")
+	}
+}
+
+func TestCheckSublimeKeys(t *testing.T) {
+	tests := []struct {
+		name   string
+		syntax string
+		want   []string
+	}{
+		{"known", "scope: source.test\nversion: 2\ncontexts:\n  main:\n    - match: a\n      scope: a\n      comment: c\n", nil},
+		{"unsupported", "scope: source.test\nextends: Packages/x\ncontexts:\n  main:\n    - match: a\n      branch_point: b\n",
+			[]string{"extends: unsupported key", "contexts.main[0].branch_point: unsupported key"}},
+		{"anonymous context", "scope: source.test\ncontexts:\n  main:\n    - match: a\n      push:\n        - meta_scope: s\n        - match: b\n          pops: true\n",
+			[]string{"contexts.main[0].push[1].pops: unknown key"}},
+		{"context list", "scope: source.test\ncontexts:\n  main:\n    - match: a\n      set: [a, [{matchs: b}]]\n",
+			[]string{"contexts.main[0].set[1][0].matchs: unknown key"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errs, err := CheckSublimeKeys([]byte(test.syntax))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := keyErrors(errs); !slices.Equal(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStrictDecode(t *testing.T) {
+	const grammar = `{"scopeName": "source.strict", "patterns": [{"match": "a", "contentName": "c"}]}`
+	fsys := fstest.MapFS{"strict.tmLanguage.json": {Data: []byte(grammar)}}
+	tests := []struct {
+		name string
+		opts []LoaderOption
+		want int
+	}{
+		{"lenient", nil, 0},
+		{"strict", []LoaderOption{WithStrictDecode()}, 2},
+		{"strict and lazy", []LoaderOption{WithStrictDecode(), WithLazyDecode()}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l, err := NewLoaderFromFS(fsys, false, test.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := l.Register([]byte(`{"scopeName": "source.registered", "foo": 1}`), FormatJSON); err != nil {
+				t.Fatal(err)
+			}
+			diags := l.Diagnostics()
+			if len(diags) != test.want {
+				t.Fatalf("got %v, want %d diagnostics", diags, test.want)
+			}
+			for _, diag := range diags {
+				var kerr *KeyError
+				if !errors.As(diag, &kerr) {
+					t.Errorf("got %v, want a *KeyError", diag)
+				}
+			}
+			if test.want > 0 && (diags[0].Path != "strict.tmLanguage.json" || diags[1].Scope != "source.registered") {
+				t.Errorf("got %v, want the file and the registered grammar", diags)
+			}
+		})
+	}
+}
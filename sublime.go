@@ -0,0 +1,575 @@
+package textmate
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+
+	"github.com/friedelschoen/go-textmate/regexp"
+)
+
+// SublimeSyntax is a decoded Sublime Text `.sublime-syntax` file.
+//
+// Contexts are compiled into the rule tree as-is, `push`, `set` and `pop` mutate the parse stack
+// like blocks of TextMate grammars. The `escape` of an `embed` takes priority over every context
+// pushed inside the embedded syntax. Not supported are `branch_point`/`fail`, `with_prototype`,
+// `clear_scopes` and inheritance with `extends`; rules using them are compiled without.
+type SublimeSyntax struct {
+	Name           string                   `yaml:"name"`
+	Scope          string                   `yaml:"scope"`
+	FileExtensions []string                 `yaml:"file_extensions"`
+	FirstLineMatch string                   `yaml:"first_line_match"`
+	Hidden         bool                     `yaml:"hidden"`
+	Variables      map[string]string        `yaml:"variables"`
+	Contexts       map[string][]SublimeRule `yaml:"contexts"`
+}
+
+// SublimeRule is an entry of a context: a match, an include or meta data of the context.
+type SublimeRule struct {
+	Match          string          `yaml:"match"`
+	Scope          string          `yaml:"scope"`
+	Captures       map[int]string  `yaml:"captures"`
+	Push           SublimeContexts `yaml:"push"`
+	Set            SublimeContexts `yaml:"set"`
+	Pop            SublimePop      `yaml:"pop"`
+	Embed          string          `yaml:"embed"`
+	EmbedScope     string          `yaml:"embed_scope"`
+	Escape         string          `yaml:"escape"`
+	EscapeCaptures map[int]string  `yaml:"escape_captures"`
+	Include        string          `yaml:"include"`
+
+	MetaScope            string `yaml:"meta_scope"`
+	MetaContentScope     string `yaml:"meta_content_scope"`
+	MetaIncludePrototype *bool  `yaml:"meta_include_prototype"`
+}
+
+// SublimeContext refers to a context by Name, or is an anonymous context with Rules.
+// Names may refer to other syntaxes as `scope:source.c` or `Packages/C/C.sublime-syntax`.
+type SublimeContext struct {
+	Name  string
+	Rules []SublimeRule
+}
+
+// SublimeContexts is the target of `push` and `set`, which is a single context or a list of them.
+type SublimeContexts []SublimeContext
+
+func (cs *SublimeContexts) UnmarshalYAML(node *yaml.Node) error {
+	switch {
+	case node.Kind == yaml.ScalarNode:
+		*cs = SublimeContexts{{Name: node.Value}}
+	case node.Kind == yaml.SequenceNode && (len(node.Content) == 0 || node.Content[0].Kind == yaml.MappingNode):
+		var rules []SublimeRule
+		if err := node.Decode(&rules); err != nil {
+			return err
+		}
+		*cs = SublimeContexts{{Rules: rules}}
+	case node.Kind == yaml.SequenceNode:
+		*cs = nil
+		for _, item := range node.Content {
+			var sub SublimeContexts
+			if err := item.Decode(&sub); err != nil {
+				return err
+			}
+			*cs = append(*cs, sub...)
+		}
+	default:
+		return fmt.Errorf("line %d: expected context name or list of contexts", node.Line)
+	}
+	return nil
+}
+
+// SublimePop is the number of contexts a rule pops, `pop: true` meaning one.
+type SublimePop int
+
+func (p *SublimePop) UnmarshalYAML(node *yaml.Node) error {
+	var b bool
+	if err := node.Decode(&b); err == nil {
+		*p = 0
+		if b {
+			*p = 1
+		}
+		return nil
+	}
+	var n int
+	if err := node.Decode(&n); err != nil {
+		return err
+	}
+	*p = SublimePop(n)
+	return nil
+}
+
+// DecodeSublimeSyntax decodes a `.sublime-syntax` file.
+func DecodeSublimeSyntax(content []byte) (*SublimeSyntax, error) {
+	var syntax SublimeSyntax
+	if err := yaml.Unmarshal(stripYAMLDirective(content), &syntax); err != nil {
+		return nil, err
+	}
+	return &syntax, nil
+}
+
+// GrammarJSON returns the metadata of the syntax as a grammar. Contexts cannot be expressed as
+// TextMate rules, instead the result carries the syntax and CompileGrammar compiles it natively.
+func (s *SublimeSyntax) GrammarJSON() *GrammarJSON {
+	return &GrammarJSON{
+		Name:      s.Name,
+		ScopeName: s.Scope,
+		FileTypes: s.FileExtensions,
+		FirstLine: s.FirstLineMatch,
+		sublime:   s,
+	}
+}
+
+// expand substitutes variables written as `{{name}}` in source.
+func (s *SublimeSyntax) expand(source string, depth int) (string, error) {
+	if depth > 32 {
+		return "", errors.New("variables nested too deep")
+	}
+	var res strings.Builder
+	for {
+		start := strings.Index(source, "{{")
+		if start == -1 {
+			break
+		}
+		end := strings.Index(source[start+2:], "}}")
+		if end == -1 {
+			break
+		}
+		name := source[start+2 : start+2+end]
+		value, ok := s.Variables[name]
+		if !ok {
+			return "", fmt.Errorf("unknown variable `%s`", name)
+		}
+		value, err := s.expand(value, depth+1)
+		if err != nil {
+			return "", err
+		}
+		res.WriteString(source[:start])
+		res.WriteString(value)
+		source = source[start+2+end+2:]
+	}
+	res.WriteString(source)
+	return res.String(), nil
+}
+
+// sublimeContext is a compiled context, rules are evaluated while it is on top of the stack.
+type sublimeContext struct {
+	metaScope        string
+	metaContentScope string
+	rules            []rule
+	escape           *sublimeRule /* escape of an embed, which pops the context from any depth */
+}
+
+// sublimeRule matches a pattern and then pops and pushes contexts.
+type sublimeRule struct {
+	scope    string
+	pattern  *pattern
+	captures []string
+	pop      int
+	set      bool /* the popped context ends before the match */
+	push     []*sublimeContext
+	grammar  *Grammar
+}
+
+func (rule *sublimeRule) evaluate(offset int, text string, top *StackItem, yield func(*Token), basegrammar *Grammar, param *regexp.MatchParam) (*StackItem, int, error) {
+	expr, cerr := rule.pattern.get()
+	if cerr != nil {
+		return top, 0, cerr
+	}
+	groups, err := expr.MatchWithParam(text, 0, len(text), regexp.OptionNotBeginPosition, param)
+	if err != nil || groups == nil {
+		return top, 0, err
+	}
+	length := groups[0].Len()
+	if length == 0 && rule.pop == 0 && len(rule.push) == 0 {
+		/* an empty match leaving the stack as-is would not progress */
+		return top, 0, nil
+	}
+	var pushed []*sublimeContext /* contexts pushed by empty matches at offset, passed to the new top */
+	if length == 0 {
+		if top.emptyOffset == offset {
+			pushed = top.emptyPushes
+		}
+		if len(rule.push) > 0 {
+			ctx := rule.push[len(rule.push)-1]
+			if slices.Contains(pushed, ctx) {
+				/* the context was pushed here before without progress, pushing it again would loop */
+				return top, 0, nil
+			}
+			pushed = append(slices.Clip(pushed), ctx)
+		}
+	}
+
+	end := offset + length
+	if rule.set {
+		end = offset
+	}
+	depth := top.Depth()
+	for n := rule.pop; n > 0 && top.previous != nil; n-- {
+		top.yieldMeta(offset, end, yield)
+		top = top.previous
+	}
+	for _, ctx := range rule.push {
+		top = &StackItem{
+			rules:         ctx.rules,
+			offset:        offset,
+			previous:      top,
+			metaScope:     ctx.metaScope,
+			contentScope:  ctx.metaContentScope,
+			contentOffset: offset + length,
+			escape:        ctx.escape,
+		}
+	}
+	if len(rule.push) > 0 {
+		depth = top.Depth()
+	}
+	if length == 0 {
+		if len(rule.push) == 0 {
+			/* frames of the caller are left as-is, the popped-to frame is replaced by a copy */
+			frame := *top
+			top = &frame
+		}
+		top.emptyOffset, top.emptyPushes = offset, pushed
+	}
+
+	if rule.scope != "" && length > 0 {
+		yield(&Token{
+			Scope:  rule.scope,
+			Start:  offset,
+			Length: length,
+			Depth:  depth,
+		})
+	}
+	for i, rng := range groups {
+		if i >= len(rule.captures) {
+			break
+		}
+		if rng.Len() == 0 || rule.captures[i] == "" {
+			continue
+		}
+		yield(&Token{
+			Scope:  rule.captures[i],
+			Start:  offset + rng.Start,
+			Length: rng.Len(),
+			Depth:  depth,
+		})
+	}
+
+	if length == 0 {
+		return top, -1, nil
+	}
+	return top, length, nil
+}
+
+// escapeEmbed tries the escapes of the embeds on the stack of top at the start of text, the
+// outermost embed first. A matching escape pops its embed and every context above it, the result
+// is like that of evaluate.
+func escapeEmbed(offset int, text string, top *StackItem, yield func(*Token), param *regexp.MatchParam) (*StackItem, int, error) {
+	var embed *StackItem
+	var groups []regexp.Range
+	for si := top; si != nil; si = si.previous {
+		if si.escape == nil {
+			continue
+		}
+		expr, cerr := si.escape.pattern.get()
+		if cerr != nil {
+			return top, 0, cerr
+		}
+		match, err := expr.MatchWithParam(text, 0, len(text), regexp.OptionNotBeginPosition, param)
+		if err != nil {
+			return top, 0, err
+		}
+		if match != nil {
+			embed, groups = si, match
+		}
+	}
+	if embed == nil {
+		return top, 0, nil
+	}
+	length := groups[0].Len()
+	for si := top; si != embed; si = si.previous {
+		si.yieldMeta(offset, offset, yield)
+	}
+	embed.yieldMeta(offset, offset+length, yield)
+	depth := embed.Depth()
+	for i, rng := range groups {
+		if i >= len(embed.escape.captures) {
+			break
+		}
+		if rng.Len() == 0 || embed.escape.captures[i] == "" {
+			continue
+		}
+		yield(&Token{
+			Scope:  embed.escape.captures[i],
+			Start:  offset + rng.Start,
+			Length: rng.Len(),
+			Depth:  depth,
+		})
+	}
+	if length == 0 {
+		/* popping the embed is progress */
+		return embed.previous, -1, nil
+	}
+	return embed.previous, length, nil
+}
+
+// yieldMeta emits the meta scopes of a context which is popped by a match at start,
+// end is where the meta scope ends.
+func (si *StackItem) yieldMeta(start int, end int, yield func(*Token)) {
+	depth := si.Depth()
+	if si.contentScope != "" && start > si.contentOffset {
+		yield(&Token{
+			Scope:  si.contentScope,
+			Start:  si.contentOffset,
+			Length: start - si.contentOffset,
+			Depth:  depth,
+		})
+	}
+	if si.metaScope != "" && end > si.offset {
+		yield(&Token{
+			Scope:  si.metaScope,
+			Start:  si.offset,
+			Length: end - si.offset,
+			Depth:  depth,
+		})
+	}
+}
+
+// sublimeCompiler compiles the contexts of a syntax into grammar.
+type sublimeCompiler struct {
+	grammar  *Grammar
+	syntax   *SublimeSyntax
+	contexts map[string]*sublimeContext
+}
+
+// compileSublime compiles the contexts of s into the repository of g, `main` becoming the root.
+func compileSublime(g *Grammar, s *SublimeSyntax) error {
+	c := sublimeCompiler{
+		grammar:  g,
+		syntax:   s,
+		contexts: make(map[string]*sublimeContext, len(s.Contexts)),
+	}
+	names := slices.Sorted(maps.Keys(s.Contexts))
+	/* contexts may push each other, so all exist before any is compiled */
+	for _, name := range names {
+		c.contexts[name] = &sublimeContext{}
+	}
+	g.repository = make(map[string]rule, len(s.Contexts))
+	for _, name := range names {
+		path := jsonPath("contexts", name)
+		rules, err := c.compileRules(s.Contexts[name], path)
+		if err != nil {
+			if !g.collect(err) {
+				return err
+			}
+			continue
+		}
+		body := &expandRule{name: name, rules: rules, grammar: g}
+		g.repository[name] = body
+		c.fill(c.contexts[name], s.Contexts[name], body, name != "prototype")
+	}
+
+	main, ok := c.contexts["main"]
+	if !ok {
+		return g.errorAt("contexts", errors.New("syntax has no `main` context"))
+	}
+	g.root = &expandRule{name: g.scopeName, rules: main.rules, grammar: g}
+	return nil
+}
+
+// fill sets the meta data and rules of ctx, the prototype is included first unless disabled.
+func (c *sublimeCompiler) fill(ctx *sublimeContext, rules []SublimeRule, body rule, prototype bool) {
+	for _, r := range rules {
+		if r.MetaScope != "" {
+			ctx.metaScope = r.MetaScope
+		}
+		if r.MetaContentScope != "" {
+			ctx.metaContentScope = r.MetaContentScope
+		}
+		if r.MetaIncludePrototype != nil && !*r.MetaIncludePrototype {
+			prototype = false
+		}
+	}
+	ctx.rules = nil
+	if _, ok := c.syntax.Contexts["prototype"]; ok && prototype {
+		ctx.rules = append(ctx.rules, &includeRule{rulename: "prototype", grammar: c.grammar})
+	}
+	ctx.rules = append(ctx.rules, body)
+}
+
+// compileRules compiles the rules of a context found at path, skipping meta data.
+func (c *sublimeCompiler) compileRules(rules []SublimeRule, path string) ([]rule, error) {
+	res := make([]rule, 0, len(rules))
+	for i, r := range rules {
+		rule, err := c.compileRule(r, fmt.Sprintf("%s[%d]", path, i))
+		if err != nil {
+			if !c.grammar.collect(err) {
+				return nil, err
+			}
+			continue
+		}
+		if rule != nil {
+			res = append(res, rule)
+		}
+	}
+	return res, nil
+}
+
+// compileRule compiles a single entry of a context, meta data results in a nil rule.
+func (c *sublimeCompiler) compileRule(r SublimeRule, path string) (rule, error) {
+	switch {
+	case r.Include != "":
+		return c.include(r.Include, jsonPath(path, "include"))
+	case r.Match != "" || r.Pop != 0 || r.Push != nil || r.Set != nil || r.Embed != "":
+		match, err := c.pattern(r.Match, jsonPath(path, "match"))
+		if err != nil {
+			return nil, err
+		}
+		res := &sublimeRule{
+			scope:    r.Scope,
+			pattern:  match,
+			captures: sublimeCaptures(r.Captures),
+			pop:      int(r.Pop),
+			grammar:  c.grammar,
+		}
+		switch {
+		case r.Embed != "":
+			if r.Escape == "" {
+				return nil, c.grammar.errorAt(path, errors.New("`embed` without `escape`"))
+			}
+			escape, err := c.pattern(r.Escape, jsonPath(path, "escape"))
+			if err != nil {
+				return nil, err
+			}
+			target, err := c.include(r.Embed, jsonPath(path, "embed"))
+			if err != nil {
+				return nil, err
+			}
+			res.push = []*sublimeContext{{
+				metaContentScope: r.EmbedScope,
+				rules:            []rule{target},
+				escape: &sublimeRule{
+					pattern:  escape,
+					captures: sublimeCaptures(r.EscapeCaptures),
+					grammar:  c.grammar,
+				},
+			}}
+		case r.Set != nil:
+			res.pop = 1
+			res.set = true
+			res.push, err = c.targets(r.Set, jsonPath(path, "set"))
+		case r.Push != nil:
+			res.push, err = c.targets(r.Push, jsonPath(path, "push"))
+		}
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+	return nil, nil
+}
+
+// pattern expands the variables in source and registers it with the grammar.
+func (c *sublimeCompiler) pattern(source string, path string) (*pattern, error) {
+	source, err := c.syntax.expand(source, 0)
+	if err != nil {
+		return nil, c.grammar.errorAt(path, err)
+	}
+	if source == "" {
+		/* an empty match is common to pop or push without consuming */
+		source = "(?:)"
+	}
+	return c.grammar.pattern(source, path), nil
+}
+
+// targets resolves the contexts pushed by a rule, anonymous contexts are compiled in place.
+func (c *sublimeCompiler) targets(cs SublimeContexts, path string) ([]*sublimeContext, error) {
+	res := make([]*sublimeContext, len(cs))
+	for i, sc := range cs {
+		itempath := path
+		if len(cs) > 1 {
+			itempath = fmt.Sprintf("%s[%d]", path, i)
+		}
+		if sc.Name == "" {
+			rules, err := c.compileRules(sc.Rules, itempath)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = &sublimeContext{}
+			c.fill(res[i], sc.Rules, &expandRule{rules: rules, grammar: c.grammar}, true)
+			continue
+		}
+		if ctx, ok := c.contexts[sc.Name]; ok {
+			res[i] = ctx
+			continue
+		}
+		/* contexts of other syntaxes are entered without their meta data */
+		include, err := c.include(sc.Name, itempath)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = &sublimeContext{rules: []rule{include}}
+	}
+	return res, nil
+}
+
+// include resolves a reference to a context of this or another syntax.
+func (c *sublimeCompiler) include(ref string, path string) (rule, error) {
+	switch {
+	case strings.HasPrefix(ref, "scope:"):
+		scopename, rulename, _ := strings.Cut(strings.TrimPrefix(ref, "scope:"), "#")
+		return c.grammar.include(scopename, rulename), nil
+	case strings.HasPrefix(ref, "Packages/"):
+		file, rulename, _ := strings.Cut(ref, "#")
+		scopename, ok := c.grammar.loader.sublimeScope(file)
+		if !ok {
+			return nil, c.grammar.errorAt(path, fmt.Errorf("unknown syntax `%s`", file))
+		}
+		return c.grammar.include(scopename, rulename), nil
+	}
+	if _, ok := c.syntax.Contexts[ref]; !ok {
+		return nil, c.grammar.errorAt(path, fmt.Errorf("unknown context `%s`", ref))
+	}
+	return c.grammar.include("", ref), nil
+}
+
+// sublimeCaptures converts captures to a slice indexed by group.
+func sublimeCaptures(captures map[int]string) []string {
+	if len(captures) == 0 {
+		return nil
+	}
+	maxcaptures := 0
+	for i := range captures {
+		maxcaptures = max(maxcaptures, i)
+	}
+	res := make([]string, maxcaptures+1)
+	for i, scope := range captures {
+		if i >= 0 {
+			res[i] = scope
+		}
+	}
+	return res
+}
+
+// sublimeScope returns the scope of the loaded Sublime syntax named by file, such as
+// `Packages/C++/C.sublime-syntax`. Syntaxes are matched by their base name. It is called while
+// compiling, l.mu must not be held.
+func (l *Loader) sublimeScope(file string) (string, bool) {
+	if l == nil {
+		return "", false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	base := path.Base(file)
+	for scope, grms := range l.scopes {
+		/* the syntax may not be decoded yet, so it is recognized by its file name */
+		if grm := grms[0]; hasExt(grm.filename, sublimeExts) && path.Base(grm.filename) == base {
+			return scope, true
+		}
+	}
+	return "", false
+}
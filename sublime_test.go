@@ -0,0 +1,191 @@
+package textmate
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// compileSublimeTest compiles the Sublime syntax in content without a loader.
+func compileSublimeTest(t *testing.T, content string) *Grammar {
+	t.Helper()
+	syntax, err := DecodeSublimeSyntax([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := CompileGrammar(nil, syntax.GrammarJSON())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(g.Close)
+	return g
+}
+
+// embedSyntax embeds the context `inner` between `<s>` and `</s>`.
+const embedSyntax = `
+scope: source.test
+contexts:
+  main:
+    - match: '<s>'
+      scope: tag.begin
+      embed: inner
+      embed_scope: embedded
+      escape: '</s>'
+      escape_captures:
+        0: tag.end
+  inner:
+    - match: '"'
+      push: string
+  string:
+    - meta_scope: string
+    - match: '\('
+      push: group
+    - match: '"'
+      pop: true
+  group:
+    - meta_scope: group
+    - match: '\)'
+      pop: true
+`
+
+func TestSublimeTokenize(t *testing.T) {
+	tests := []struct {
+		name   string
+		syntax string
+		text   string
+		want   []string
+	}{
+		{"push and pop", `
+scope: source.test
+contexts:
+  main:
+    - match: '"'
+      scope: punctuation
+      push: string
+  string:
+    - meta_scope: string
+    - match: '"'
+      scope: punctuation
+      pop: true
+`, `a "b" c`, []string{`punctuation:"`, `string:"b"`, `punctuation:"`}},
+		{"meta_content_scope", `
+scope: source.test
+contexts:
+  main:
+    - match: '\('
+      push: group
+  group:
+    - meta_content_scope: inner
+    - match: '\)'
+      pop: true
+`, `(ab)`, []string{`inner:ab`}},
+		/* the match which sets a context is scoped by its meta scope */
+		{"set", `
+scope: source.test
+contexts:
+  main:
+    - match: 'fn'
+      scope: keyword
+      push: name
+  name:
+    - match: '\w+'
+      scope: entity
+      set: body
+  body:
+    - meta_scope: body
+    - match: ';'
+      pop: true
+`, `fn f x;`, []string{`keyword:fn`, `entity:f`, `body:f x;`}},
+		{"anonymous context", `
+scope: source.test
+contexts:
+  main:
+    - match: '<'
+      push:
+        - meta_scope: tag
+        - match: '>'
+          pop: true
+`, `<a>`, []string{`tag:<a>`}},
+		{"embed", embedSyntax, `<s>"a"</s> "x"`, []string{`tag.begin:<s>`, `embedded:"a"`, `string:"a"`, `tag.end:</s>`}},
+		{"embed without push", embedSyntax, `<s>a</s>"x"`, []string{`tag.begin:<s>`, `embedded:a`, `tag.end:</s>`}},
+		/* the escape pops the unterminated string as well */
+		{"embed unterminated", embedSyntax, `<s>"abc</s> "x"`, []string{`tag.begin:<s>`, `embedded:"abc`, `string:"abc`, `tag.end:</s>`}},
+		{"embed nested", embedSyntax, `<s>"a("b</s>"x"`, []string{`tag.begin:<s>`, `embedded:"a("b`, `string:"a("b`, `group:("b`, `tag.end:</s>`}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := compileSublimeTest(t, test.syntax)
+			if got := scopes(t, g, test.text); !slices.Equal(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSublimeEmptyPushTerminates(t *testing.T) {
+	tests := []struct {
+		name   string
+		syntax string
+	}{
+		{"push and pop", `
+scope: source.test
+contexts:
+  main:
+    - match: '(?=\S)'
+      push: b
+  b:
+    - match: ''
+      pop: true
+`},
+		{"push itself", `
+scope: source.test
+contexts:
+  main:
+    - match: ''
+      push: main
+`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := compileSublimeTest(t, test.syntax)
+			done := make(chan []string)
+			go func() {
+				done <- scopes(t, g, "ab cd\nef")
+			}()
+			select {
+			case got := <-done:
+				if len(got) != 0 {
+					t.Errorf("got %q, want unscoped text", got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("tokenizer does not terminate")
+			}
+		})
+	}
+}
+
+func TestSublimeStackReuse(t *testing.T) {
+	g := compileSublimeTest(t, `
+scope: source.test
+contexts:
+  main:
+    - match: '(?=\S)'
+      push: word
+  word:
+    - match: '\w+'
+      scope: keyword
+      pop: true
+`)
+	root := g.StackItem()
+	for i := range 3 {
+		var got []string
+		_, err := TokenizeSequence(0, "x", root, func(tok *Token) {
+			if tok.Scope != "" {
+				got = append(got, tok.Scope)
+			}
+		}, g)
+		if err != nil || !slices.Equal(got, []string{"keyword"}) {
+			t.Errorf("run %d: got %q, %v, want [keyword]", i, got, err)
+		}
+	}
+}
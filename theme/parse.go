@@ -2,23 +2,40 @@
 package theme
 
 import (
+	"bytes"
+	"encoding/json"
 	"image"
 	"image/color"
 	"strings"
+
+	"go.yaml.in/yaml/v3"
 )
 
 type ThemeJSON struct {
-	Default TokenColorJSON   `json:"default"`
-	Tokens  []TokenColorJSON `json:"tokens"`
+	Default TokenColorJSON   `json:"default" yaml:"default"`
+	Tokens  []TokenColorJSON `json:"tokens" yaml:"tokens"`
 }
 
 type TokenColorJSON struct {
-	Scope    any `json:"scope"`
+	Scope    any `json:"scope" yaml:"scope"`
 	Settings struct {
-		Foreground string `json:"foreground"`
-		Background string `json:"background"`
-		FontStyle  string `json:"fontStyle"`
-	} `json:"settings"`
+		Foreground string `json:"foreground" yaml:"foreground"`
+		Background string `json:"background" yaml:"background"`
+		FontStyle  string `json:"fontStyle" yaml:"fontStyle"`
+	} `json:"settings" yaml:"settings"`
+}
+
+// DecodeTheme decodes a theme written in JSON or YAML, the format is detected from the content.
+func DecodeTheme(content []byte) (ThemeJSON, error) {
+	var j ThemeJSON
+	var err error
+	trimmed := bytes.TrimLeft(bytes.TrimPrefix(content, []byte("\xef\xbb\xbf")), " \t\r\n")
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		err = json.Unmarshal(trimmed, &j)
+	} else {
+		err = yaml.Unmarshal(content, &j)
+	}
+	return j, err
 }
 
 type FontStyle int
@@ -0,0 +1,45 @@
+package theme
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestDecodeTheme(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		scopes  []string /* scope of each token, nil if invalid */
+	}{
+		{"json", `{"default": {"settings": {"foreground": "#fff"}}, "tokens": [{"scope": "keyword", "settings": {"foreground": "#f00"}}]}`,
+			[]string{"keyword"}},
+		{"json with bom", "\xef\xbb\xbf\n" + `{"default": {"settings": {"foreground": "#fff"}}, "tokens": []}`,
+			[]string{}},
+		{"yaml", "default:\n  settings:\n    foreground: '#fff'\ntokens:\n  - scope: [string, comment]\n    settings:\n      fontStyle: italic\n",
+			[]string{"[string comment]"}},
+		{"invalid json", `{"default": `, nil},
+		{"invalid yaml", "default: [\n", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			j, err := DecodeTheme([]byte(test.content))
+			if test.scopes == nil {
+				if err == nil {
+					t.Errorf("got %+v, want an error", j)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, tok := range j.Tokens {
+				got = append(got, fmt.Sprint(tok.Scope))
+			}
+			if j.Default.Settings.Foreground != "#fff" || !slices.Equal(got, test.scopes) {
+				t.Errorf("got %+v, want default #fff and scopes %q", j, test.scopes)
+			}
+		})
+	}
+}
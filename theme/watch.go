@@ -0,0 +1,111 @@
+package theme
+
+import (
+	"context"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ThemeFile is a theme loaded from a file, which is read again by Reload when it changes.
+type ThemeFile struct {
+	path string
+
+	mu          sync.Mutex
+	theme       *Theme
+	size        int64
+	modTime     time.Time
+	subscribers []*func(*Theme)
+}
+
+// LoadThemeFile reads and parses the theme at path, see DecodeTheme.
+func LoadThemeFile(path string) (*ThemeFile, error) {
+	f := &ThemeFile{path: path}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.load(info); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// load reads the theme, whose file is described by info.
+func (f *ThemeFile) load(info os.FileInfo) error {
+	/* recorded first, so that a broken file is reported once until it changes again */
+	f.size, f.modTime = info.Size(), info.ModTime()
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	j, err := DecodeTheme(content)
+	if err != nil {
+		return err
+	}
+	f.theme = ParseTheme(j)
+	return nil
+}
+
+// Theme returns the theme as of the last successful load.
+func (f *ThemeFile) Theme() *Theme {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.theme
+}
+
+// Subscribe calls fn with the new theme after every Reload which changed it, the returned
+// function cancels the subscription.
+func (f *ThemeFile) Subscribe(fn func(*Theme)) (cancel func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sub := &fn
+	f.subscribers = append(f.subscribers, sub)
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.subscribers = slices.DeleteFunc(f.subscribers, func(other *func(*Theme)) bool {
+			return other == sub
+		})
+	}
+}
+
+// Reload reads the theme again if its file changed, judged by its size and modification time,
+// and reports whether it did. If the file fails to load, the previous theme is kept.
+func (f *ThemeFile) Reload() (bool, error) {
+	f.mu.Lock()
+	info, err := os.Stat(f.path)
+	if err != nil || (info.Size() == f.size && info.ModTime().Equal(f.modTime)) {
+		f.mu.Unlock()
+		return false, err
+	}
+	if err := f.load(info); err != nil {
+		f.mu.Unlock()
+		return false, err
+	}
+	theme := f.theme
+	subscribers := slices.Clone(f.subscribers)
+	f.mu.Unlock()
+
+	for _, fn := range subscribers {
+		(*fn)(theme)
+	}
+	return true, nil
+}
+
+// Watch calls Reload every interval until ctx is done, errors are passed to onError if not nil.
+func (f *ThemeFile) Watch(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := f.Reload(); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
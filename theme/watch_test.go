@@ -0,0 +1,143 @@
+package theme
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeFile writes content to name, with a modification time after the previous one so
+// that Reload notices the change.
+func writeFile(t *testing.T, name string, content string) {
+	t.Helper()
+	modTime := time.Now()
+	if info, err := os.Stat(name); err == nil {
+		modTime = info.ModTime().Add(time.Second)
+	}
+	if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// foreground returns the default foreground of theme as hex.
+func foreground(theme *Theme) string {
+	if theme.Foreground == nil {
+		return ""
+	}
+	r, g, b, _ := theme.Foreground.RGBA()
+	return fmt.Sprintf("#%02x%02x%02x", r>>8, g>>8, b>>8)
+}
+
+// themeWith is a theme with the default foreground fg.
+func themeWith(fg string) string {
+	return `{"default": {"settings": {"foreground": "` + fg + `"}}, "tokens": []}`
+}
+
+func TestThemeFileReload(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "theme.json")
+	writeFile(t, name, themeWith("#ff0000"))
+	f, err := LoadThemeFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var notified []string
+	cancel := f.Subscribe(func(theme *Theme) {
+		notified = append(notified, foreground(theme))
+	})
+	defer cancel()
+
+	tests := []struct {
+		name    string
+		change  func()
+		changed bool
+		fg      string /* default foreground after reloading */
+		err     bool
+	}{
+		{"unchanged", func() {}, false, "#ff0000", false},
+		{"changed", func() {
+			writeFile(t, name, themeWith("#00ff00"))
+		}, true, "#00ff00", false},
+		{"yaml", func() {
+			writeFile(t, name, "default:\n  settings:\n    foreground: '#0000ff'\n")
+		}, true, "#0000ff", false},
+		{"broken", func() {
+			writeFile(t, name, `{"default": `)
+		}, false, "#0000ff", true},
+		{"broken again", func() {}, false, "#0000ff", false},
+		{"removed", func() {
+			os.Remove(name)
+		}, false, "#0000ff", true},
+	}
+	for _, test := range tests {
+		test.change()
+		changed, err := f.Reload()
+		if changed != test.changed || (err != nil) != test.err {
+			t.Errorf("%s: Reload = %v, %v, want %v", test.name, changed, err, test.changed)
+		}
+		if got := foreground(f.Theme()); got != test.fg {
+			t.Errorf("%s: foreground %s, want %s", test.name, got, test.fg)
+		}
+	}
+	if len(notified) != 2 || notified[0] != "#00ff00" || notified[1] != "#0000ff" {
+		t.Errorf("subscriber notified of %q, want the 2 reloaded themes", notified)
+	}
+
+	if _, err := LoadThemeFile(name); err == nil {
+		t.Error("LoadThemeFile of a missing file: no error")
+	}
+}
+
+func TestThemeFileWatch(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "theme.json")
+	writeFile(t, name, themeWith("#ff0000"))
+	f, err := LoadThemeFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := make(chan *Theme, 1)
+	defer f.Subscribe(func(theme *Theme) {
+		reloaded <- theme
+	})()
+	errs := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		f.Watch(ctx, time.Millisecond, func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		})
+		close(done)
+	}()
+
+	writeFile(t, name, themeWith("#00ff00"))
+	select {
+	case theme := <-reloaded:
+		if got := foreground(theme); got != "#00ff00" {
+			t.Errorf("reloaded foreground %s, want #00ff00", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("theme not reloaded")
+	}
+
+	writeFile(t, name, `{"default": `)
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("broken theme not reported")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch did not return after cancel")
+	}
+}
@@ -0,0 +1,201 @@
+package textmate
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Tier is the source of a grammar. When several grammars claim a scope or file type, the
+// grammar of the highest tier is used; within a tier the grammar loaded last is used. Loading
+// order is deterministic: directories are read in lexical order.
+//
+// Grammars claiming the same scope override each other as a whole, the file types of an
+// overridden grammar resolve to the grammar overriding it.
+type Tier int
+
+const (
+	// TierSystem is for grammars installed system-wide, it is the default.
+	TierSystem Tier = iota
+	// TierUser is for grammars of the user, such as those in `~/.local`.
+	TierUser
+	// TierProject is for grammars of the project at hand.
+	TierProject
+)
+
+func (t Tier) String() string {
+	switch t {
+	case TierSystem:
+		return "system"
+	case TierUser:
+		return "user"
+	case TierProject:
+		return "project"
+	}
+	return fmt.Sprintf("Tier(%d)", int(t))
+}
+
+// WithTier sets the tier of the grammars loaded by the constructor, TierSystem by default.
+func WithTier(tier Tier) LoaderOption {
+	return func(l *Loader) {
+		l.tier = tier
+	}
+}
+
+// Candidate is a grammar claiming a scope or file type.
+type Candidate struct {
+	Scope string
+	Name  string
+	// File is the grammar file, empty if it was registered at runtime.
+	File string
+	Tier Tier
+	// Reason explains why the candidate was chosen or not.
+	Reason string
+}
+
+// Resolution explains how a grammar was chosen, see Loader.ExplainScope.
+type Resolution struct {
+	// Match describes what was looked up, such as "extension `d.ts`".
+	Match string
+	// Candidates are ordered by priority, the first one is used.
+	Candidates []Candidate
+}
+
+// comparePriority orders grammars by priority, the highest first.
+func comparePriority(a *GrammarJSON, b *GrammarJSON) int {
+	if c := cmp.Compare(b.tier, a.tier); c != 0 {
+		return c
+	}
+	return cmp.Compare(b.seq, a.seq)
+}
+
+// reindex rebuilds the scope and file type indices from the loaded grammars, l.mu must be held.
+func (l *Loader) reindex() {
+	grammars := slices.Clone(l.grammars)
+	slices.SortFunc(grammars, comparePriority)
+	l.scopes = make(map[string][]*GrammarJSON)
+	l.filetypes = make(map[string][]string)
+	l.filenames = make(map[string]bool)
+	for _, grm := range grammars {
+		l.scopes[grm.ScopeName] = append(l.scopes[grm.ScopeName], grm)
+		for _, ft := range grm.FileTypes {
+			ft = strings.TrimLeft(ft, ".")
+			if !slices.Contains(l.filetypes[ft], grm.ScopeName) {
+				l.filetypes[ft] = append(l.filetypes[ft], grm.ScopeName)
+			}
+			if isFileName(ft) {
+				l.filenames[ft] = true
+			}
+		}
+	}
+	for _, lang := range l.languages {
+		for _, name := range lang.Filenames {
+			l.filenames[strings.TrimLeft(name, ".")] = true
+		}
+	}
+	l.buildLanguages()
+	/* compiled grammars which are overridden now would not be used anymore */
+	for grm := range l.cache {
+		if l.winner(grm.ScopeName) != grm {
+			delete(l.cache, grm)
+		}
+	}
+}
+
+// winner returns the grammar used for scope or nil, l.mu must be held.
+func (l *Loader) winner(scope string) *GrammarJSON {
+	if grms := l.scopes[scope]; len(grms) > 0 {
+		return grms[0]
+	}
+	return nil
+}
+
+// candidate describes grm, which is at index in grms.
+func candidate(grms []*GrammarJSON, index int) Candidate {
+	grm := grms[index]
+	res := Candidate{
+		Scope: grm.ScopeName,
+		Name:  grm.Name,
+		File:  grm.filename,
+		Tier:  grm.tier,
+	}
+	switch {
+	case index > 0:
+		res.Reason = fmt.Sprintf("overridden by %s", describe(grms[0]))
+	case len(grms) == 1:
+		res.Reason = "only candidate"
+	case grm.tier > grms[1].tier:
+		res.Reason = fmt.Sprintf("%v tier overrides %v", grm.tier, grms[1].tier)
+	default:
+		res.Reason = fmt.Sprintf("loaded after %s in %v tier", describe(grms[1]), grm.tier)
+	}
+	return res
+}
+
+// describe names grm in explanations.
+func describe(grm *GrammarJSON) string {
+	if grm.filename != "" {
+		return grm.filename
+	}
+	return fmt.Sprintf("`%s`", grm.ScopeName)
+}
+
+// ExplainScope lists every grammar claiming scope, the first of which is used by FromScope.
+func (l *Loader) ExplainScope(scope string) (Resolution, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	grms := l.scopes[scope]
+	if len(grms) == 0 {
+		return Resolution{}, os.ErrNotExist
+	}
+	res := Resolution{Match: fmt.Sprintf("scope `%s`", scope)}
+	for i := range grms {
+		res.Candidates = append(res.Candidates, candidate(grms, i))
+	}
+	return res, nil
+}
+
+// ExplainFileType lists the grammars for ft in the order of the index of FromFileType, grammars
+// overridden by these are listed by ExplainScope.
+func (l *Loader) ExplainFileType(ft string) (Resolution, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.explainFileType(fmt.Sprintf("file type `%s`", ft), ft)
+}
+
+// ExplainFileName tells which rule of FromFileName applies to name, and the grammars it yields.
+func (l *Loader) ExplainFileName(name string) (Resolution, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	match, scope, ft := l.resolveFileName(name)
+	switch {
+	case ft != "":
+		return l.explainFileType(match, ft)
+	case scope != "":
+		res := Resolution{Match: match}
+		grms := l.scopes[scope]
+		for i := range grms {
+			res.Candidates = append(res.Candidates, candidate(grms, i))
+		}
+		return res, nil
+	}
+	return Resolution{}, os.ErrNotExist
+}
+
+func (l *Loader) explainFileType(match string, ft string) (Resolution, error) {
+	scopes := l.filetypes[ft]
+	if len(scopes) == 0 {
+		return Resolution{}, os.ErrNotExist
+	}
+	res := Resolution{Match: match}
+	for i, scope := range scopes {
+		cand := candidate(l.scopes[scope], 0)
+		if i > 0 {
+			cand.Reason = fmt.Sprintf("ranked after `%s` for %s", scopes[i-1], match)
+		}
+		res.Candidates = append(res.Candidates, cand)
+	}
+	return res, nil
+}
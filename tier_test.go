@@ -0,0 +1,81 @@
+package textmate
+
+import (
+	"slices"
+	"testing"
+	"testing/fstest"
+)
+
+func TestTierOrder(t *testing.T) {
+	grammar := func(name string, ft string) *fstest.MapFile {
+		return &fstest.MapFile{Data: []byte(`{"name": "` + name + `", "scopeName": "source.test", "fileTypes": ["` + ft + `"], "patterns": []}`)}
+	}
+	tests := []struct {
+		name  string
+		tiers []Tier /* tier of each directory, added in order */
+		want  []string
+	}{
+		{"higher tier", []Tier{TierSystem, TierUser}, []string{"1", "0"}},
+		{"lower tier added later", []Tier{TierProject, TierSystem}, []string{"0", "1"}},
+		{"same tier", []Tier{TierUser, TierUser}, []string{"1", "0"}},
+		{"three tiers", []Tier{TierUser, TierProject, TierSystem}, []string{"1", "0", "2"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l, _ := NewLoader(nil)
+			for i, tier := range test.tiers {
+				name := string(rune('0' + i))
+				fsys := fstest.MapFS{"test.json": grammar(name, "t"+name)}
+				if err := l.AddFS(fsys, false, tier); err != nil {
+					t.Fatal(err)
+				}
+			}
+			res, err := l.ExplainScope("source.test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, cand := range res.Candidates {
+				got = append(got, cand.Name)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			g, err := l.FromScope("source.test")
+			if err != nil || g.Name() != test.want[0] {
+				t.Errorf("FromScope = %v, %v, want grammar %s", g, err, test.want[0])
+			}
+			/* file types of overridden grammars resolve to the grammar overriding them */
+			for i := range test.tiers {
+				if g, err := l.FromFileType("t"+string(rune('0'+i)), 0); err != nil || g.Name() != test.want[0] {
+					t.Errorf("FromFileType(t%d) = %v, %v, want grammar %s", i, g, err, test.want[0])
+				}
+			}
+		})
+	}
+}
+
+func TestRegisterGrammarCopies(t *testing.T) {
+	grm, err := DecodeGrammar([]byte(testGrammar), FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, _ := NewLoader(nil, WithTier(TierUser))
+	system, _ := NewLoader(nil)
+	for _, l := range []*Loader{user, system} {
+		if err := l.RegisterGrammar(grm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	/* registering grm in the system tier leaves it in the user tier of the first loader */
+	res, err := user.ExplainScope("source.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Candidates) != 1 || res.Candidates[0].Tier != TierUser {
+		t.Errorf("got candidates %+v, want one in the user tier", res.Candidates)
+	}
+	if grm.tier != 0 || grm.seq != 0 {
+		t.Errorf("RegisterGrammar set tier %v and seq %d of the caller's grammar", grm.tier, grm.seq)
+	}
+}